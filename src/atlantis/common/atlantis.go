@@ -23,6 +23,10 @@ const (
 	StatusUnknown     = "UNKNOWN"
 	StatusDone        = "DONE"
 	StatusInit        = "INIT"
+	StatusQueued      = "QUEUED"      // Task status while waiting for a worker
+	StatusInterrupted = "INTERRUPTED" // Task status when the process died while the task was running
+	StatusCancelled   = "CANCELLED"
+	StatusTimedOut    = "TIMED_OUT"
 	StatusFull        = "FULL" // Supervisor Health Check status when no more containers are available
 	ManifestFile      = "manifest.toml"
 	DefaultLDAPPort   = uint16(636)
@@ -43,7 +47,8 @@ type VersionReply struct {
 // ------------ Async -----------
 // used to for async requests
 type AsyncReply struct {
-	ID string
+	ID       string
+	Existing *TaskStatus // set instead of starting a task when its idempotency key was already used
 }
 
 // ----------------------------------------------------------------------------------------------------------
@@ -12,14 +12,21 @@
 package common
 
 import (
+	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/rpc"
 	"strings"
 	"time"
 )
 
+// the status net/rpc answers a CONNECT with
+const rpcConnected = "200 Connected to Go RPC"
+
 // Returns false if the two major versions mismatch
 func CompatibleVersions(v1, v2 string) bool {
 	major1 := strings.SplitN(v1, ".", 2)
@@ -44,6 +51,8 @@ type RPCClient struct {
 	UseTLS       bool
 	VersionError error
 	VersionOk    bool
+	Cache        *RPCCache
+	Codec        *RPCCodecOpts
 }
 
 type ClientResult struct {
@@ -57,52 +66,135 @@ func NewRPCClient(hostAndPort, baseName, rpcVersion string, useTLS bool) *RPCCli
 
 func NewRPCClientWithConfig(config RPCServerOpts, baseName, rpcVersion string, useTLS bool) *RPCClient {
 	configs := []RPCServerOpts{config}
-	return &RPCClient{baseName, rpcVersion, configs, useTLS, nil, false}
+	return &RPCClient{baseName, rpcVersion, configs, useTLS, nil, false, nil, nil}
 }
 
 func NewMultiRPCClientWithConfig(configs []RPCServerOpts, baseName, rpcVersion string, useTLS bool) *RPCClient {
-	return &RPCClient{baseName, rpcVersion, configs, useTLS, nil, false}
+	return &RPCClient{baseName, rpcVersion, configs, useTLS, nil, false, nil, nil}
+}
+
+// EnableCache turns on client-side caching for the given read-only methods. Replies are reused until their
+// method's TTL expires or the cache is invalidated.
+func (r *RPCClient) EnableCache(ttls map[string]time.Duration, maxEntries int) *RPCCache {
+	r.Cache = NewRPCCache(ttls, maxEntries)
+	return r.Cache
+}
+
+// EnableFramedCodec switches the client to the framed codec, which enforces size limits and compresses large
+// payloads. The server has to serve it (see FramedRPCHandler and ServeFramed).
+func (r *RPCClient) EnableFramedCodec(opts *RPCCodecOpts) {
+	r.Codec = opts
 }
 
 func (r *RPCClient) newClient(region int) (*rpc.Client, error) {
+	if r.Codec != nil {
+		return r.newFramedClient(region)
+	}
 	if r.UseTLS {
 		return r.newTLSClient(region)
 	}
-	return rpc.DialHTTP("tcp", r.Opts[region].RPCHostAndPort())
+	return r.newHTTPClient(region)
 }
 
 func (r *RPCClient) newClientOnChannel(region int) chan *ClientResult {
 	c := make(chan *ClientResult)
 	go func() {
-		if r.UseTLS {
-			client, err := r.newTLSClient(region)
-			c <- &ClientResult{client: client, err: err}
-		} else {
-			client, err := rpc.DialHTTP("tcp", r.Opts[region].RPCHostAndPort())
-			c <- &ClientResult{client: client, err: err}
-		}
+		client, err := r.newClient(region)
+		c <- &ClientResult{client: client, err: err}
 	}()
 	return c
 }
 
-func (r *RPCClient) tlsConfig() (*tls.Config, error) {
+// newHTTPClient does what rpc.DialHTTP does, but over a connection from dial so that it can go through a
+// proxy.
+func (r *RPCClient) newHTTPClient(region int) (*rpc.Client, error) {
+	conn, err := r.dial(region, r.Opts[region].RPCHostAndPort())
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (r *RPCClient) newFramedClient(region int) (*rpc.Client, error) {
+	conn, err := r.dial(region, r.Opts[region].RPCHostAndPort())
+	if err != nil {
+		return nil, err
+	}
+	var reader *bufio.Reader
+	if !r.UseTLS {
+		io.WriteString(conn, "CONNECT "+DefaultRPCFramedPath+" HTTP/1.0\n\n")
+		reader = bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+		if err == nil && resp.Status != rpcFramedConnected {
+			err = errors.New("unexpected HTTP response: " + resp.Status)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	codec, err := newRPCClientCodec(conn, reader, r.Codec)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClientWithCodec(codec), nil
+}
+
+func (r *RPCClient) tlsConfig(region int) (*tls.Config, error) {
 	var err error
 	config := &tls.Config{}
 	config.InsecureSkipVerify = true
+	if opts, ok := r.Opts[region].(RPCPinnedServerOpts); ok && len(opts.RPCPinnedKeys()) > 0 {
+		config.VerifyPeerCertificate = verifyPins(opts.RPCPinnedKeys())
+	}
 	return config, err
 }
 
 func (r *RPCClient) newTLSClient(region int) (*rpc.Client, error) {
-	config, err := r.tlsConfig()
+	conn, err := r.dial(region, r.Opts[region].RPCHostAndPort())
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// dial opens a connection to addr, through the region's proxy if it has one and wrapped in TLS if the client
+// uses it.
+func (r *RPCClient) dial(region int, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if opts, ok := r.Opts[region].(RPCProxiedServerOpts); ok && opts.RPCProxyURL() != "" {
+		conn, err = dialProxy(opts.RPCProxyURL(), addr)
+	} else {
+		conn, err = net.Dial("tcp", addr)
 	}
-	conn, err := tls.Dial("tcp", r.Opts[region].RPCHostAndPort(), config)
+	if err != nil || !r.UseTLS {
+		return conn, err
+	}
+	config, err := r.tlsConfig(region)
 	if err != nil {
-		panic(err)
+		conn.Close()
+		return nil, err
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
 	}
-	c := rpc.NewClient(conn)
-	return c, err
+	return tlsConn, nil
 }
 
 func (r *RPCClient) checkVersion(region int) error {
@@ -182,10 +274,19 @@ func (r *RPCClient) Call(name string, arg interface{}, reply interface{}) error
 }
 
 func (r *RPCClient) CallMulti(name string, arg interface{}, region int, reply interface{}) error {
+	if r.Cache != nil && r.Cache.Get(name, region, arg, reply) {
+		return nil
+	}
 	if err := r.checkVersion(region); err != nil {
 		return err
 	}
-	return r.doRequest(name, arg, region, reply)
+	if err := r.doRequest(name, arg, region, reply); err != nil {
+		return err
+	}
+	if r.Cache != nil {
+		r.Cache.Put(name, region, arg, reply)
+	}
+	return nil
 }
 
 func (r *RPCClient) CallWithTimeout(name string, arg interface{}, reply interface{}, timeout int) error {
@@ -193,8 +294,17 @@ func (r *RPCClient) CallWithTimeout(name string, arg interface{}, reply interfac
 }
 
 func (r *RPCClient) CallMultiWithTimeout(name string, arg interface{}, region int, reply interface{}, timeout int) error {
+	if r.Cache != nil && r.Cache.Get(name, region, arg, reply) {
+		return nil
+	}
 	if err := r.checkVersionWithTimeout(region, timeout); err != nil {
 		return err
 	}
-	return r.doRequestWithTimeout(name, arg, region, reply, timeout)
+	if err := r.doRequestWithTimeout(name, arg, region, reply, timeout); err != nil {
+		return err
+	}
+	if r.Cache != nil {
+		r.Cache.Put(name, region, arg, reply)
+	}
+	return nil
 }
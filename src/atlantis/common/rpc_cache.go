@@ -0,0 +1,149 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultRPCCacheSize = 256
+
+// RPCCache holds replies to read-only RPC methods for a short time so that repeated reads don't go back to
+// the server. Only methods listed in TTLs are cached. Entries are keyed by method, region and the
+// gob-encoded argument, and the least recently used entries are evicted once MaxEntries is reached.
+type RPCCache struct {
+	sync.Mutex
+	TTLs       map[string]time.Duration
+	MaxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type rpcCacheEntry struct {
+	key     string
+	method  string
+	reply   []byte
+	expires time.Time
+}
+
+func NewRPCCache(ttls map[string]time.Duration, maxEntries int) *RPCCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultRPCCacheSize
+	}
+	return &RPCCache{TTLs: ttls, MaxEntries: maxEntries, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *RPCCache) ttl(method string) time.Duration {
+	if c.TTLs == nil {
+		return 0
+	}
+	return c.TTLs[method]
+}
+
+func (c *RPCCache) key(method string, region int, arg interface{}) (string, bool) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(arg); err != nil {
+		// an argument we can't encode is an argument we can't key on. just don't cache it.
+		return "", false
+	}
+	return method + "|" + strconv.Itoa(region) + "|" + buf.String(), true
+}
+
+// Get fills reply from the cache and returns true if a live entry exists for the call.
+func (c *RPCCache) Get(method string, region int, arg interface{}, reply interface{}) bool {
+	if c.ttl(method) <= 0 {
+		return false
+	}
+	key, ok := c.key(method, region, arg)
+	if !ok {
+		return false
+	}
+	c.Lock()
+	elem, present := c.entries[key]
+	if !present {
+		c.Unlock()
+		return false
+	}
+	entry := elem.Value.(*rpcCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		c.Unlock()
+		return false
+	}
+	c.lru.MoveToFront(elem)
+	data := entry.reply
+	c.Unlock()
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(reply) == nil
+}
+
+// Put stores the reply to a successful call if the method is cacheable.
+func (c *RPCCache) Put(method string, region int, arg interface{}, reply interface{}) {
+	ttl := c.ttl(method)
+	if ttl <= 0 {
+		return
+	}
+	key, ok := c.key(method, region, arg)
+	if !ok {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(reply); err != nil {
+		return
+	}
+	entry := &rpcCacheEntry{key: key, method: method, reply: buf.Bytes(), expires: time.Now().Add(ttl)}
+	c.Lock()
+	if elem, present := c.entries[key]; present {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+	c.Unlock()
+}
+
+// Invalidate drops every cached reply for the given method.
+func (c *RPCCache) Invalidate(method string) {
+	c.Lock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*rpcCacheEntry).method == method {
+			c.remove(elem)
+		}
+		elem = next
+	}
+	c.Unlock()
+}
+
+func (c *RPCCache) InvalidateAll() {
+	c.Lock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.Unlock()
+}
+
+func (c *RPCCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
+
+// must hold the lock
+func (c *RPCCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*rpcCacheEntry).key)
+	c.lru.Remove(elem)
+}
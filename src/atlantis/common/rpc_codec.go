@@ -0,0 +1,437 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Framed RPC Codec
+//
+// The framed codec is a drop-in for net/rpc's gob codec that puts every header and body in its own
+// length-prefixed frame. Knowing the size of a payload before reading it lets both sides enforce size limits,
+// and frames over a threshold are deflated. Right after connecting the client and server exchange a hello
+// that settles whether compression is on and what the limits are.
+// ----------------------------------------------------------------------------------------------------------
+
+const (
+	DefaultRPCFramedPath        = "/_atlantisRPC_"
+	DefaultRPCMaxRequestSize    = 16 << 20
+	DefaultRPCMaxResponseSize   = 64 << 20
+	DefaultRPCCompressThreshold = 16 << 10
+
+	rpcFramedConnected  = "200 Connected to Atlantis RPC"
+	rpcCodecMagic       = "ARPC"
+	rpcCodecVersion     = 1
+	rpcCodecCompress    = 1
+	rpcCodecHelloSize   = 14
+	rpcFrameHeaderSize  = 5
+	rpcFrameCompressed  = 1
+	rpcMaxHeaderFrame   = 64 << 10
+	rpcSizeDirRequest   = "request"
+	rpcSizeDirResponse  = "response"
+	rpcUnlimitedMessage = 0
+)
+
+// RPCCodecOpts configures the framed codec. A limit of 0 means unlimited and a CompressThreshold of 0 turns
+// compression off.
+type RPCCodecOpts struct {
+	MaxRequestSize    int
+	MaxResponseSize   int
+	CompressThreshold int
+}
+
+func NewRPCCodecOpts() *RPCCodecOpts {
+	return &RPCCodecOpts{DefaultRPCMaxRequestSize, DefaultRPCMaxResponseSize, DefaultRPCCompressThreshold}
+}
+
+type RPCSizeError struct {
+	Direction string
+	Method    string
+	Size      int
+	Limit     int
+}
+
+func (e *RPCSizeError) Error() string {
+	return fmt.Sprintf("RPC %s for %s is %d bytes, over the %d byte limit", e.Direction, e.Method, e.Size,
+		e.Limit)
+}
+
+func minLimit(a, b int) int {
+	if a == rpcUnlimitedMessage || (b != rpcUnlimitedMessage && b < a) {
+		return b
+	}
+	return a
+}
+
+// ------------ Handshake -----------
+
+type rpcCodecHello struct {
+	compress        bool
+	maxRequestSize  int
+	maxResponseSize int
+}
+
+func writeHello(w io.Writer, hello *rpcCodecHello) error {
+	buf := make([]byte, rpcCodecHelloSize)
+	copy(buf, rpcCodecMagic)
+	buf[4] = rpcCodecVersion
+	if hello.compress {
+		buf[5] = rpcCodecCompress
+	}
+	binary.BigEndian.PutUint32(buf[6:], uint32(hello.maxRequestSize))
+	binary.BigEndian.PutUint32(buf[10:], uint32(hello.maxResponseSize))
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHello(r io.Reader) (*rpcCodecHello, error) {
+	buf := make([]byte, rpcCodecHelloSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[:4]) != rpcCodecMagic || buf[4] != rpcCodecVersion {
+		return nil, errors.New("not a framed RPC connection")
+	}
+	return &rpcCodecHello{
+		compress:        buf[5]&rpcCodecCompress != 0,
+		maxRequestSize:  int(binary.BigEndian.Uint32(buf[6:])),
+		maxResponseSize: int(binary.BigEndian.Uint32(buf[10:])),
+	}, nil
+}
+
+// ------------ Frames -----------
+
+type rpcFramer struct {
+	conn      io.ReadWriteCloser
+	r         *bufio.Reader
+	w         *bufio.Writer
+	compress  bool
+	threshold int
+}
+
+func newRPCFramer(conn io.ReadWriteCloser, r *bufio.Reader) *rpcFramer {
+	if r == nil {
+		r = bufio.NewReader(conn)
+	}
+	return &rpcFramer{conn: conn, r: r, w: bufio.NewWriter(conn)}
+}
+
+func (f *rpcFramer) encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (f *rpcFramer) writeFrame(payload []byte) error {
+	var flags byte
+	if f.compress && f.threshold > 0 && len(payload) > f.threshold {
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write(payload)
+		zw.Close()
+		if buf.Len() < len(payload) {
+			payload = buf.Bytes()
+			flags |= rpcFrameCompressed
+		}
+	}
+	header := make([]byte, rpcFrameHeaderSize)
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := f.w.Write(header); err != nil {
+		return err
+	}
+	_, err := f.w.Write(payload)
+	return err
+}
+
+// readFrame returns the next payload. If it is bigger than limit it is skipped and a nil payload is returned
+// along with its size, so the stream stays in sync and the caller can report the error.
+func (f *rpcFramer) readFrame(limit int) ([]byte, int, error) {
+	header := make([]byte, rpcFrameHeaderSize)
+	if _, err := io.ReadFull(f.r, header); err != nil {
+		return nil, 0, err
+	}
+	size := int(binary.BigEndian.Uint32(header[1:]))
+	if limit != rpcUnlimitedMessage && size > limit {
+		_, err := io.CopyN(ioutil.Discard, f.r, int64(size))
+		return nil, size, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		return nil, size, err
+	}
+	if header[0]&rpcFrameCompressed == 0 {
+		return payload, size, nil
+	}
+	var zr io.Reader = flate.NewReader(bytes.NewReader(payload))
+	if limit != rpcUnlimitedMessage {
+		// don't let a small frame inflate into something huge
+		zr = io.LimitReader(zr, int64(limit)+1)
+	}
+	payload, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, size, err
+	}
+	if limit != rpcUnlimitedMessage && len(payload) > limit {
+		return nil, len(payload), nil
+	}
+	return payload, len(payload), nil
+}
+
+func decodeFrame(payload []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
+
+// ------------ Client -----------
+
+type rpcFramedClientCodec struct {
+	*rpcFramer
+	maxRequestSize  int
+	maxResponseSize int
+	method          string
+}
+
+// NewRPCClientCodec does the client side of the handshake on conn and returns a codec for rpc.NewClientWithCodec.
+func NewRPCClientCodec(conn io.ReadWriteCloser, opts *RPCCodecOpts) (rpc.ClientCodec, error) {
+	return newRPCClientCodec(conn, nil, opts)
+}
+
+func newRPCClientCodec(conn io.ReadWriteCloser, r *bufio.Reader, opts *RPCCodecOpts) (rpc.ClientCodec, error) {
+	framer := newRPCFramer(conn, r)
+	hello := &rpcCodecHello{opts.CompressThreshold > 0, opts.MaxRequestSize, opts.MaxResponseSize}
+	if err := writeHello(conn, hello); err != nil {
+		return nil, err
+	}
+	reply, err := readHello(framer.r)
+	if err != nil {
+		return nil, err
+	}
+	framer.compress = reply.compress
+	framer.threshold = opts.CompressThreshold
+	return &rpcFramedClientCodec{
+		rpcFramer:       framer,
+		maxRequestSize:  minLimit(opts.MaxRequestSize, reply.maxRequestSize),
+		maxResponseSize: opts.MaxResponseSize,
+	}, nil
+}
+
+func (c *rpcFramedClientCodec) WriteRequest(req *rpc.Request, body interface{}) error {
+	header, err := c.encode(req)
+	if err != nil {
+		return err
+	}
+	payload, err := c.encode(body)
+	if err != nil {
+		return err
+	}
+	if c.maxRequestSize != rpcUnlimitedMessage && len(payload) > c.maxRequestSize {
+		return &RPCSizeError{rpcSizeDirRequest, req.ServiceMethod, len(payload), c.maxRequestSize}
+	}
+	if err := c.writeFrame(header); err != nil {
+		return err
+	}
+	if err := c.writeFrame(payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *rpcFramedClientCodec) ReadResponseHeader(resp *rpc.Response) error {
+	payload, size, err := c.readFrame(rpcMaxHeaderFrame)
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return &RPCSizeError{rpcSizeDirResponse, "header", size, rpcMaxHeaderFrame}
+	}
+	if err := decodeFrame(payload, resp); err != nil {
+		return err
+	}
+	c.method = resp.ServiceMethod
+	return nil
+}
+
+func (c *rpcFramedClientCodec) ReadResponseBody(body interface{}) error {
+	payload, size, err := c.readFrame(c.maxResponseSize)
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return &RPCSizeError{rpcSizeDirResponse, c.method, size, c.maxResponseSize}
+	}
+	return decodeFrame(payload, body)
+}
+
+func (c *rpcFramedClientCodec) Close() error {
+	return c.conn.Close()
+}
+
+// ------------ Server -----------
+
+type rpcFramedServerCodec struct {
+	*rpcFramer
+	maxRequestSize  int
+	maxResponseSize int
+	method          string
+}
+
+// NewRPCServerCodec does the server side of the handshake on conn and returns a codec for rpc.ServeCodec.
+func NewRPCServerCodec(conn io.ReadWriteCloser, opts *RPCCodecOpts) (rpc.ServerCodec, error) {
+	return newRPCServerCodec(conn, nil, opts)
+}
+
+func newRPCServerCodec(conn io.ReadWriteCloser, r *bufio.Reader, opts *RPCCodecOpts) (rpc.ServerCodec, error) {
+	framer := newRPCFramer(conn, r)
+	hello, err := readHello(framer.r)
+	if err != nil {
+		return nil, err
+	}
+	reply := &rpcCodecHello{
+		compress:        hello.compress && opts.CompressThreshold > 0,
+		maxRequestSize:  opts.MaxRequestSize,
+		maxResponseSize: minLimit(hello.maxResponseSize, opts.MaxResponseSize),
+	}
+	if err := writeHello(conn, reply); err != nil {
+		return nil, err
+	}
+	framer.compress = reply.compress
+	framer.threshold = opts.CompressThreshold
+	return &rpcFramedServerCodec{
+		rpcFramer:       framer,
+		maxRequestSize:  reply.maxRequestSize,
+		maxResponseSize: reply.maxResponseSize,
+	}, nil
+}
+
+func (c *rpcFramedServerCodec) ReadRequestHeader(req *rpc.Request) error {
+	payload, size, err := c.readFrame(rpcMaxHeaderFrame)
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return &RPCSizeError{rpcSizeDirRequest, "header", size, rpcMaxHeaderFrame}
+	}
+	if err := decodeFrame(payload, req); err != nil {
+		return err
+	}
+	c.method = req.ServiceMethod
+	return nil
+}
+
+func (c *rpcFramedServerCodec) ReadRequestBody(body interface{}) error {
+	payload, size, err := c.readFrame(c.maxRequestSize)
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		// net/rpc sends this back to the client as the call's error
+		return &RPCSizeError{rpcSizeDirRequest, c.method, size, c.maxRequestSize}
+	}
+	return decodeFrame(payload, body)
+}
+
+func (c *rpcFramedServerCodec) WriteResponse(resp *rpc.Response, body interface{}) error {
+	payload, err := c.encode(body)
+	if err != nil {
+		return err
+	}
+	if c.maxResponseSize != rpcUnlimitedMessage && len(payload) > c.maxResponseSize && resp.Error == "" {
+		// the client would refuse this anyways. tell it why instead.
+		resp.Error = (&RPCSizeError{rpcSizeDirResponse, resp.ServiceMethod, len(payload),
+			c.maxResponseSize}).Error()
+		if payload, err = c.encode(struct{}{}); err != nil {
+			return err
+		}
+	}
+	header, err := c.encode(resp)
+	if err != nil {
+		return err
+	}
+	if err := c.writeFrame(header); err != nil {
+		return err
+	}
+	if err := c.writeFrame(payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *rpcFramedServerCodec) Close() error {
+	return c.conn.Close()
+}
+
+// ServeFramedConn runs server on a single connection using the framed codec.
+func ServeFramedConn(server *rpc.Server, conn io.ReadWriteCloser, opts *RPCCodecOpts) {
+	serveFramedConn(server, conn, nil, opts)
+}
+
+func serveFramedConn(server *rpc.Server, conn io.ReadWriteCloser, r *bufio.Reader, opts *RPCCodecOpts) {
+	codec, err := newRPCServerCodec(conn, r, opts)
+	if err != nil {
+		log.Print("[RPC] framed handshake: ", err.Error())
+		conn.Close()
+		return
+	}
+	server.ServeCodec(codec)
+}
+
+// ServeFramed accepts connections on l and serves each with the framed codec, like rpc.Server.Accept.
+func ServeFramed(server *rpc.Server, l net.Listener, opts *RPCCodecOpts) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Print("[RPC] framed accept: ", err.Error())
+			return
+		}
+		go ServeFramedConn(server, conn, opts)
+	}
+}
+
+// FramedRPCHandler serves framed RPC over HTTP CONNECT, like rpc.Server does. Mount it at
+// DefaultRPCFramedPath next to the regular handler so that old clients keep working.
+type FramedRPCHandler struct {
+	Server *rpc.Server
+	Opts   *RPCCodecOpts
+}
+
+func (h *FramedRPCHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("[RPC] framed hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+rpcFramedConnected+"\n\n")
+	serveFramedConn(h.Server, conn, buf.Reader, h.Opts)
+}
@@ -0,0 +1,222 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// RPCServerOpts can implement this to reach an endpoint through a jump host. The URL is either
+// http://[user:pass@]host:port for an HTTP CONNECT proxy or socks5://[user:pass@]host:port for a SOCKS5
+// proxy. An empty URL dials directly.
+type RPCProxiedServerOpts interface {
+	RPCProxyURL() string
+}
+
+type ProxiedRPCServerOpts struct {
+	HostAndPort string
+	ProxyURL    string
+}
+
+func (o ProxiedRPCServerOpts) RPCHostAndPort() string {
+	return o.HostAndPort
+}
+
+func (o ProxiedRPCServerOpts) RPCProxyURL() string {
+	return o.ProxyURL
+}
+
+// dialProxy returns a connection to addr tunneled through the proxy at proxyURL.
+func dialProxy(proxyURL, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	var handshake func(net.Conn, *url.Userinfo, string) (net.Conn, error)
+	switch u.Scheme {
+	case "http":
+		handshake = httpConnect
+	case "socks5":
+		handshake = socks5Connect
+	default:
+		return nil, errors.New("Unsupported Proxy Scheme: " + u.Scheme)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := handshake(conn, u.User, addr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s: %s", u.Host, err.Error())
+	}
+	return tunnel, nil
+}
+
+// bufferedConn keeps anything the proxy sent past its handshake response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("CONNECT failed: " + resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
+
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPassAuth = 2
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+var socks5Errors = []string{
+	"",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	method := byte(socks5NoAuth)
+	if user != nil {
+		method = socks5UserPassAuth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != socks5Version {
+		return nil, errors.New("unexpected SOCKS version " + strconv.Itoa(int(buf[0])))
+	}
+	if buf[1] == socks5NoAcceptable || buf[1] != method {
+		return nil, errors.New("SOCKS authentication method rejected")
+	}
+	if method == socks5UserPassAuth {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return nil, errors.New("SOCKS credentials too long")
+		}
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, errors.New("SOCKS authentication failed")
+		}
+	}
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, socks5IPv4), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, socks5IPv6), ip.To16()...)
+	} else {
+		// let the proxy resolve names, the jump host can usually see DNS we can't
+		if len(host) > 255 {
+			return nil, errors.New("SOCKS host name too long")
+		}
+		req = append(append(req, socks5Domain, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[1] != 0 {
+		reason := "unknown error " + strconv.Itoa(int(header[1]))
+		if int(header[1]) < len(socks5Errors) {
+			reason = socks5Errors[header[1]]
+		}
+		return nil, errors.New("SOCKS connect failed: " + reason)
+	}
+	// skip the bound address, we have no use for it
+	var skip int
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		skip = int(buf[0])
+	default:
+		return nil, errors.New("unexpected SOCKS address type " + strconv.Itoa(int(header[3])))
+	}
+	bound := make([]byte, skip+2)
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,473 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Subscriptions
+//
+// A StreamServer pushes messages published on a topic to every client subscribed to it. Subscriptions use a
+// dedicated connection set up with an HTTP CONNECT (just like net/rpc does) to DefaultStreamPath, after which
+// the server writes gob-encoded StreamFrames. Idle connections get heartbeats so clients can tell a quiet
+// topic from a dead server, and every topic keeps a backlog so a client that reconnects can resume from the
+// last sequence number it saw. Sequence numbers only mean something to the server run (epoch) that assigned
+// them. A client that can't resume, because the server restarted or the messages it missed already left the
+// backlog, gets a StreamGap frame instead and should refetch whatever state it keeps.
+// ----------------------------------------------------------------------------------------------------------
+
+const (
+	DefaultStreamPath              = "/_atlantisStream_"
+	DefaultStreamHeartbeatInterval = 10 * time.Second
+	DefaultStreamBacklog           = 1024
+	DefaultStreamSubscriberBuffer  = 64
+	// pass as fromSeq to only receive messages published after subscribing
+	StreamFromNow = ^uint64(0)
+
+	streamConnected     = "200 Connected to Atlantis Stream"
+	streamMinBackoff    = 100 * time.Millisecond
+	streamMaxBackoff    = 10 * time.Second
+	streamMissedBeats   = 3
+	streamWriteDeadline = 10 * time.Second
+	streamEpochSize     = 16
+)
+
+const (
+	StreamData = iota
+	StreamHeartbeat
+	StreamClose
+	StreamGap // messages were missed, the stream continues after Seq
+)
+
+var ErrStreamClosed = errors.New("Stream Closed")
+
+// RPCServerOpts can implement this to serve subscriptions somewhere other than RPCHostAndPort.
+type RPCStreamServerOpts interface {
+	RPCStreamHostAndPort() string
+}
+
+type StreamSubscribeArg struct {
+	Topic   string
+	FromSeq uint64
+	Epoch   string // the server run FromSeq came from, "" if unknown
+}
+
+type StreamFrame struct {
+	Kind     int
+	Topic    string
+	Seq      uint64
+	Time     time.Time
+	Interval time.Duration // heartbeat interval, only set on heartbeats
+	Epoch    string        // only set on heartbeats and gaps
+	Body     []byte
+}
+
+// Decode decodes the gob-encoded message carried by a data frame.
+func (f *StreamFrame) Decode(v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(f.Body)).Decode(v)
+}
+
+// ------------ Server -----------
+
+type StreamServer struct {
+	sync.Mutex
+	Epoch             string // tells this run of the server apart from earlier ones
+	HeartbeatInterval time.Duration
+	BacklogSize       int
+	SubscriberBuffer  int
+	topics            map[string]*streamTopic
+	closed            bool
+	done              chan struct{}
+	conns             sync.WaitGroup
+}
+
+type streamTopic struct {
+	seq     uint64
+	backlog []*StreamFrame
+	subs    map[chan *StreamFrame]bool
+}
+
+func NewStreamServer() *StreamServer {
+	return &StreamServer{
+		Epoch:             CreateRandomID(streamEpochSize),
+		HeartbeatInterval: DefaultStreamHeartbeatInterval,
+		BacklogSize:       DefaultStreamBacklog,
+		SubscriberBuffer:  DefaultStreamSubscriberBuffer,
+		topics:            map[string]*streamTopic{},
+		done:              make(chan struct{}),
+	}
+}
+
+// must hold the lock
+func (s *StreamServer) topic(name string) *streamTopic {
+	topic := s.topics[name]
+	if topic == nil {
+		topic = &streamTopic{subs: map[chan *StreamFrame]bool{}}
+		s.topics[name] = topic
+	}
+	return topic
+}
+
+// Publish sends msg to every subscriber of topic and returns its sequence number.
+func (s *StreamServer) Publish(topic string, msg interface{}) (uint64, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return 0, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	t := s.topic(topic)
+	t.seq++
+	frame := &StreamFrame{Kind: StreamData, Topic: topic, Seq: t.seq, Time: time.Now(), Body: buf.Bytes()}
+	t.backlog = append(t.backlog, frame)
+	if len(t.backlog) > s.BacklogSize {
+		t.backlog = t.backlog[len(t.backlog)-s.BacklogSize:]
+	}
+	for sub := range t.subs {
+		select {
+		case sub <- frame:
+		default:
+			// subscriber can't keep up. drop it, it will reconnect and catch up from the backlog.
+			delete(t.subs, sub)
+			close(sub)
+		}
+	}
+	return t.seq, nil
+}
+
+func (s *StreamServer) subscribe(arg *StreamSubscribeArg) (chan *StreamFrame, []*StreamFrame, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, nil, 0, ErrStreamClosed
+	}
+	t := s.topic(arg.Topic)
+	backlog := []*StreamFrame{}
+	if arg.FromSeq != StreamFromNow {
+		from, gap := arg.FromSeq, false
+		if arg.Epoch != "" && arg.Epoch != s.Epoch {
+			// numbered by an earlier run of the server
+			from, gap = 0, true
+		}
+		first := t.seq + 1
+		if len(t.backlog) > 0 {
+			first = t.backlog[0].Seq
+		}
+		if from+1 < first {
+			from, gap = first-1, true
+		}
+		if gap {
+			backlog = append(backlog, &StreamFrame{Kind: StreamGap, Topic: arg.Topic, Seq: from,
+				Time: time.Now(), Epoch: s.Epoch})
+		}
+		for _, frame := range t.backlog {
+			if frame.Seq > from {
+				backlog = append(backlog, frame)
+			}
+		}
+	}
+	sub := make(chan *StreamFrame, s.SubscriberBuffer)
+	t.subs[sub] = true
+	return sub, backlog, t.seq, nil
+}
+
+func (s *StreamServer) unsubscribe(topic string, sub chan *StreamFrame) {
+	s.Lock()
+	if t := s.topics[topic]; t != nil && t.subs[sub] {
+		delete(t.subs, sub)
+		close(sub)
+	}
+	s.Unlock()
+}
+
+// ServeHTTP accepts subscriptions. Mount it at DefaultStreamPath.
+func (s *StreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("[Stream] hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+streamConnected+"\n\n")
+	s.serve(conn, buf.Reader)
+}
+
+// ServeConn serves a single subscription on a connection that has skipped the HTTP CONNECT handshake.
+func (s *StreamServer) ServeConn(conn net.Conn) {
+	s.serve(conn, conn)
+}
+
+func (s *StreamServer) serve(conn net.Conn, r io.Reader) {
+	s.conns.Add(1)
+	defer s.conns.Done()
+	defer conn.Close()
+	var arg StreamSubscribeArg
+	conn.SetReadDeadline(time.Now().Add(streamWriteDeadline))
+	if err := gob.NewDecoder(r).Decode(&arg); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	sub, backlog, seq, err := s.subscribe(&arg)
+	if err != nil {
+		return
+	}
+	defer s.unsubscribe(arg.Topic, sub)
+	enc := gob.NewEncoder(conn)
+	write := func(frame *StreamFrame) error {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteDeadline))
+		return enc.Encode(frame)
+	}
+	heartbeat := func() error {
+		return write(&StreamFrame{Kind: StreamHeartbeat, Topic: arg.Topic, Seq: seq, Time: time.Now(),
+			Interval: s.HeartbeatInterval, Epoch: s.Epoch})
+	}
+	// the first heartbeat acknowledges the subscription and tells the client how often to expect more
+	if heartbeat() != nil {
+		return
+	}
+	for _, frame := range backlog {
+		if write(frame) != nil {
+			return
+		}
+		seq = frame.Seq
+	}
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame, ok := <-sub:
+			if !ok {
+				return
+			}
+			if frame.Seq <= seq {
+				continue // already sent as part of the backlog
+			}
+			if write(frame) != nil {
+				return
+			}
+			seq = frame.Seq
+		case <-ticker.C:
+			if heartbeat() != nil {
+				return
+			}
+		case <-s.done:
+			write(&StreamFrame{Kind: StreamClose, Topic: arg.Topic, Seq: seq, Time: time.Now()})
+			return
+		}
+	}
+}
+
+// Close tells every subscriber the stream is going away and waits for their connections to finish.
+func (s *StreamServer) Close() {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.Unlock()
+	s.conns.Wait()
+}
+
+// ------------ Client -----------
+
+type Subscription struct {
+	sync.Mutex
+	Messages <-chan *StreamFrame
+	messages chan *StreamFrame
+	client   *RPCClient
+	region   int
+	addr     string
+	topic    string
+	lastSeq  uint64
+	epoch    string
+	conn     net.Conn
+	err      error
+	closed   bool
+	done     chan struct{}
+}
+
+func (r *RPCClient) Subscribe(topic string, fromSeq uint64) (*Subscription, error) {
+	return r.SubscribeMulti(topic, 0, fromSeq)
+}
+
+// SubscribeMulti subscribes to topic on the given region. Messages with a sequence number after fromSeq are
+// delivered on the subscription's Messages channel, which is closed once the subscription ends. Messages also
+// gets a StreamGap frame whenever some couldn't be delivered.
+func (r *RPCClient) SubscribeMulti(topic string, region int, fromSeq uint64) (*Subscription, error) {
+	addr := r.Opts[region].RPCHostAndPort()
+	if opts, ok := r.Opts[region].(RPCStreamServerOpts); ok {
+		addr = opts.RPCStreamHostAndPort()
+	}
+	messages := make(chan *StreamFrame)
+	s := &Subscription{Messages: messages, messages: messages, client: r, region: region, addr: addr, topic: topic,
+		lastSeq: fromSeq, done: make(chan struct{})}
+	conn, dec, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	go s.run(conn, dec)
+	return s, nil
+}
+
+func (s *Subscription) connect() (net.Conn, *gob.Decoder, error) {
+	conn, err := s.client.dial(s.region, s.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	io.WriteString(conn, "CONNECT "+DefaultStreamPath+" HTTP/1.0\n\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != streamConnected {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err == nil {
+		s.Lock()
+		arg := &StreamSubscribeArg{Topic: s.topic, FromSeq: s.lastSeq, Epoch: s.epoch}
+		err = gob.NewEncoder(conn).Encode(arg)
+		s.conn = conn
+		if s.closed {
+			err = ErrStreamClosed
+		}
+		s.Unlock()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, gob.NewDecoder(reader), nil
+}
+
+func (s *Subscription) run(conn net.Conn, dec *gob.Decoder) {
+	defer close(s.messages)
+	backoff := streamMinBackoff
+	for {
+		err := s.read(conn, dec)
+		conn.Close()
+		if s.isClosed() {
+			return
+		}
+		if err == ErrStreamClosed {
+			s.Lock()
+			s.err = err
+			s.Unlock()
+			return
+		}
+		// the connection died. keep trying to resume where we left off until someone closes us.
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(backoff):
+			}
+			if conn, dec, err = s.connect(); err == nil {
+				backoff = streamMinBackoff
+				break
+			}
+			if backoff *= 2; backoff > streamMaxBackoff {
+				backoff = streamMaxBackoff
+			}
+		}
+	}
+}
+
+func (s *Subscription) read(conn net.Conn, dec *gob.Decoder) error {
+	timeout := streamMissedBeats * DefaultStreamHeartbeatInterval
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		frame := &StreamFrame{}
+		if err := dec.Decode(frame); err != nil {
+			return err
+		}
+		switch frame.Kind {
+		case StreamHeartbeat:
+			if frame.Interval > 0 {
+				timeout = streamMissedBeats * frame.Interval
+			}
+			s.Lock()
+			if s.lastSeq == StreamFromNow {
+				s.lastSeq = frame.Seq
+			}
+			s.epoch = frame.Epoch
+			s.Unlock()
+		case StreamClose:
+			return ErrStreamClosed
+		case StreamData, StreamGap:
+			// after a gap the sequence numbers start over from the gap's
+			if frame.Kind == StreamData && frame.Seq <= s.LastSeq() {
+				continue
+			}
+			select {
+			case s.messages <- frame:
+				s.Lock()
+				s.lastSeq = frame.Seq
+				s.Unlock()
+			case <-s.done:
+				return nil
+			}
+		}
+	}
+}
+
+// LastSeq returns the sequence number of the last message delivered.
+func (s *Subscription) LastSeq() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastSeq
+}
+
+// Err returns ErrStreamClosed if the server ended the subscription.
+func (s *Subscription) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+func (s *Subscription) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
+}
+
+func (s *Subscription) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return nil
+}
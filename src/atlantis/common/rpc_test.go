@@ -0,0 +1,573 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"math/big"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RPCSuite struct{}
+
+var _ = gocheck.Suite(&RPCSuite{})
+
+type testRPCServer struct {
+	calls int32
+}
+
+type EchoArg struct {
+	Message string
+}
+
+type EchoReply struct {
+	Message string
+	Calls   int32
+}
+
+func (s *testRPCServer) Version(arg VersionArg, reply *VersionReply) error {
+	reply.RPCVersion = "1.0"
+	reply.APIVersion = "1.0"
+	return nil
+}
+
+func (s *testRPCServer) Echo(arg EchoArg, reply *EchoReply) error {
+	reply.Message = arg.Message
+	reply.Calls = atomic.AddInt32(&s.calls, 1)
+	return nil
+}
+
+func startTestRPCServer(c *gocheck.C) (*testRPCServer, net.Listener) {
+	impl := &testRPCServer{}
+	server := rpc.NewServer()
+	c.Assert(server.RegisterName("Test", impl), gocheck.IsNil)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	go http.Serve(l, mux)
+	return impl, l
+}
+
+func (s *RPCSuite) TestCache(c *gocheck.C) {
+	_, l := startTestRPCServer(c)
+	defer l.Close()
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	cache := client.EnableCache(map[string]time.Duration{"Echo": time.Minute}, 2)
+	var reply EchoReply
+	c.Assert(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.IsNil)
+	c.Check(reply, gocheck.Equals, EchoReply{"a", 1})
+	reply = EchoReply{}
+	c.Assert(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.IsNil)
+	c.Check(reply, gocheck.Equals, EchoReply{"a", 1})
+	// different argument, different entry
+	c.Assert(client.Call("Echo", EchoArg{"b"}, &reply), gocheck.IsNil)
+	c.Check(reply, gocheck.Equals, EchoReply{"b", 2})
+	c.Check(cache.Len(), gocheck.Equals, 2)
+	// size bound evicts the least recently used entry ("a")
+	c.Assert(client.Call("Echo", EchoArg{"c"}, &reply), gocheck.IsNil)
+	c.Check(cache.Len(), gocheck.Equals, 2)
+	c.Assert(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.IsNil)
+	c.Check(reply, gocheck.Equals, EchoReply{"a", 4})
+	cache.Invalidate("Echo")
+	c.Check(cache.Len(), gocheck.Equals, 0)
+	c.Assert(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.IsNil)
+	c.Check(reply, gocheck.Equals, EchoReply{"a", 5})
+}
+
+func (s *RPCSuite) TestCacheExpiry(c *gocheck.C) {
+	_, l := startTestRPCServer(c)
+	defer l.Close()
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	client.EnableCache(map[string]time.Duration{"Echo": 20 * time.Millisecond}, 0)
+	var reply EchoReply
+	c.Assert(client.CallWithTimeout("Echo", EchoArg{"a"}, &reply, 5), gocheck.IsNil)
+	c.Assert(client.CallWithTimeout("Echo", EchoArg{"a"}, &reply, 5), gocheck.IsNil)
+	c.Check(reply.Calls, gocheck.Equals, int32(1))
+	time.Sleep(40 * time.Millisecond)
+	c.Assert(client.CallWithTimeout("Echo", EchoArg{"a"}, &reply, 5), gocheck.IsNil)
+	c.Check(reply.Calls, gocheck.Equals, int32(2))
+}
+
+func startTestStreamServer(c *gocheck.C) (*StreamServer, net.Listener) {
+	server := NewStreamServer()
+	server.HeartbeatInterval = 50 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.Handle(DefaultStreamPath, server)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	go http.Serve(l, mux)
+	return server, l
+}
+
+func receiveEcho(c *gocheck.C, sub *Subscription) (uint64, string) {
+	select {
+	case frame, ok := <-sub.Messages:
+		c.Assert(ok, gocheck.Equals, true)
+		var msg EchoArg
+		c.Assert(frame.Decode(&msg), gocheck.IsNil)
+		return frame.Seq, msg.Message
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for message")
+	}
+	return 0, ""
+}
+
+func (s *RPCSuite) TestSubscribe(c *gocheck.C) {
+	server, l := startTestStreamServer(c)
+	defer l.Close()
+	server.Publish("tasks", EchoArg{"before"})
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	sub, err := client.Subscribe("tasks", 0)
+	c.Assert(err, gocheck.IsNil)
+	seq, msg := receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(1))
+	c.Check(msg, gocheck.Equals, "before")
+	server.Publish("other", EchoArg{"ignored"})
+	server.Publish("tasks", EchoArg{"after"})
+	seq, msg = receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(2))
+	c.Check(msg, gocheck.Equals, "after")
+
+	// quiet topics stay up thanks to heartbeats
+	time.Sleep(4 * server.HeartbeatInterval)
+	server.Publish("tasks", EchoArg{"quiet"})
+	_, msg = receiveEcho(c, sub)
+	c.Check(msg, gocheck.Equals, "quiet")
+
+	// a dropped connection resumes from the last sequence number without duplicates
+	sub.Lock()
+	sub.conn.Close()
+	sub.Unlock()
+	server.Publish("tasks", EchoArg{"while away"})
+	seq, msg = receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(4))
+	c.Check(msg, gocheck.Equals, "while away")
+
+	server.Close()
+	_, ok := <-sub.Messages
+	c.Check(ok, gocheck.Equals, false)
+	c.Check(sub.Err(), gocheck.Equals, ErrStreamClosed)
+}
+
+func (s *RPCSuite) TestSubscribeFromNow(c *gocheck.C) {
+	server, l := startTestStreamServer(c)
+	defer l.Close()
+	defer server.Close()
+	server.Publish("tasks", EchoArg{"old"})
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	sub, err := client.Subscribe("tasks", StreamFromNow)
+	c.Assert(err, gocheck.IsNil)
+	for sub.LastSeq() == StreamFromNow {
+		time.Sleep(time.Millisecond)
+	}
+	server.Publish("tasks", EchoArg{"new"})
+	seq, msg := receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(2))
+	c.Check(msg, gocheck.Equals, "new")
+	c.Assert(sub.Close(), gocheck.IsNil)
+	_, ok := <-sub.Messages
+	c.Check(ok, gocheck.Equals, false)
+	c.Check(sub.Err(), gocheck.IsNil)
+}
+
+func receiveGap(c *gocheck.C, sub *Subscription) uint64 {
+	select {
+	case frame, ok := <-sub.Messages:
+		c.Assert(ok, gocheck.Equals, true)
+		c.Assert(frame.Kind, gocheck.Equals, StreamGap)
+		return frame.Seq
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for gap")
+	}
+	return 0
+}
+
+func (s *RPCSuite) TestSubscribeGaps(c *gocheck.C) {
+	server, l := startTestStreamServer(c)
+	defer l.Close()
+	defer server.Close()
+	server.BacklogSize = 2
+	for _, msg := range []string{"evicted", "kept1", "kept2"} {
+		server.Publish("tasks", EchoArg{msg})
+	}
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	sub, err := client.Subscribe("tasks", 0)
+	c.Assert(err, gocheck.IsNil)
+	defer sub.Close()
+	// messages that left the backlog are reported as a gap
+	c.Check(receiveGap(c, sub), gocheck.Equals, uint64(1))
+	seq, msg := receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(2))
+	c.Check(msg, gocheck.Equals, "kept1")
+	seq, _ = receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(3))
+}
+
+func (s *RPCSuite) TestSubscribeServerRestart(c *gocheck.C) {
+	var lock sync.Mutex
+	server := NewStreamServer()
+	server.HeartbeatInterval = 50 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		current := server
+		lock.Unlock()
+		current.ServeHTTP(w, req)
+	}))
+	for _, msg := range []string{"one", "two"} {
+		server.Publish("tasks", EchoArg{msg})
+	}
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	sub, err := client.Subscribe("tasks", 0)
+	c.Assert(err, gocheck.IsNil)
+	defer sub.Close()
+	receiveEcho(c, sub)
+	seq, _ := receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(2))
+
+	// the restarted server numbers from 1 again, the client starts over after a gap instead of dropping
+	// everything up to its old sequence number
+	restarted := NewStreamServer()
+	restarted.HeartbeatInterval = 50 * time.Millisecond
+	defer restarted.Close()
+	restarted.Publish("tasks", EchoArg{"after restart"})
+	lock.Lock()
+	old := server
+	server = restarted
+	lock.Unlock()
+	sub.Lock()
+	sub.conn.Close()
+	sub.Unlock()
+	old.Close()
+	c.Check(receiveGap(c, sub), gocheck.Equals, uint64(0))
+	seq, msg := receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(1))
+	c.Check(msg, gocheck.Equals, "after restart")
+	restarted.Publish("tasks", EchoArg{"live"})
+	seq, msg = receiveEcho(c, sub)
+	c.Check(seq, gocheck.Equals, uint64(2))
+	c.Check(msg, gocheck.Equals, "live")
+}
+
+// writeTestCert writes a fresh self-signed pair to dir and returns its pin.
+func writeTestCert(c *gocheck.C, dir string, mod time.Time) (string, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gocheck.IsNil)
+	template := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: "atlantis"}, NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, gocheck.IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, gocheck.IsNil)
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	c.Assert(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600),
+		gocheck.IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		0600), gocheck.IsNil)
+	c.Assert(os.Chtimes(certFile, mod, mod), gocheck.IsNil)
+	c.Assert(os.Chtimes(keyFile, mod, mod), gocheck.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, gocheck.IsNil)
+	return certFile, keyFile, SPKIHash(cert)
+}
+
+func startTestTLSRPCServer(c *gocheck.C, config *tls.Config) net.Listener {
+	server := rpc.NewServer()
+	c.Assert(server.RegisterName("Test", &testRPCServer{}), gocheck.IsNil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	c.Assert(err, gocheck.IsNil)
+	go server.Accept(l)
+	return l
+}
+
+func (s *RPCSuite) TestTLSReloadAndPinning(c *gocheck.C) {
+	dir := c.MkDir()
+	certFile, keyFile, oldPin := writeTestCert(c, dir, time.Now().Add(-time.Minute))
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	c.Assert(err, gocheck.IsNil)
+	defer reloader.Stop()
+	l := startTestTLSRPCServer(c, reloader.TLSConfig())
+	defer l.Close()
+	addr := l.Addr().String()
+	var reply EchoReply
+
+	// no pins keeps the old behaviour of accepting anything
+	client := NewRPCClient(addr, "Test", "1.0", true)
+	c.Assert(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.IsNil)
+	client = NewRPCClientWithConfig(PinnedRPCServerOpts{addr, []string{"sha256/" + oldPin}}, "Test", "1.0", true)
+	c.Assert(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.IsNil)
+	client = NewRPCClientWithConfig(PinnedRPCServerOpts{addr, []string{"bm9wZQ=="}}, "Test", "1.0", true)
+	c.Check(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.ErrorMatches, ".*Certificate Pin Mismatch.*")
+
+	// an open connection survives the rotation, new ones get the new certificate
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, gocheck.IsNil)
+	open := rpc.NewClient(conn)
+	defer open.Close()
+	_, _, newPin := writeTestCert(c, dir, time.Now())
+	c.Assert(reloader.Reload(), gocheck.IsNil)
+	c.Assert(open.Call("Test.Echo", EchoArg{"b"}, &reply), gocheck.IsNil)
+	client = NewRPCClientWithConfig(PinnedRPCServerOpts{addr, []string{oldPin}}, "Test", "1.0", true)
+	c.Check(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.ErrorMatches, ".*Certificate Pin Mismatch.*")
+	client = NewRPCClientWithConfig(PinnedRPCServerOpts{addr, []string{oldPin, newPin}}, "Test", "1.0", true)
+	c.Check(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.IsNil)
+}
+
+func (s *RPCSuite) TestPinningIgnoresAppendedCertificates(c *gocheck.C) {
+	pinnedCert, _, pin := writeTestCert(c, c.MkDir(), time.Now())
+	evilCert, evilKey, _ := writeTestCert(c, c.MkDir(), time.Now())
+	cert, err := tls.LoadX509KeyPair(evilCert, evilKey)
+	c.Assert(err, gocheck.IsNil)
+	pinnedPEM, err := ioutil.ReadFile(pinnedCert)
+	c.Assert(err, gocheck.IsNil)
+	block, _ := pem.Decode(pinnedPEM)
+	// the pinned certificate is public, a man in the middle can send it after their own
+	cert.Certificate = append(cert.Certificate, block.Bytes)
+	l := startTestTLSRPCServer(c, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer l.Close()
+	client := NewRPCClientWithConfig(PinnedRPCServerOpts{l.Addr().String(), []string{pin}}, "Test", "1.0", true)
+	var reply EchoReply
+	c.Check(client.Call("Echo", EchoArg{"a"}, &reply), gocheck.ErrorMatches, ".*Certificate Pin Mismatch.*")
+}
+
+// pipe copies between the two connections until either side closes.
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// startTestConnectProxy stands in for a bastion running an HTTP CONNECT proxy.
+func startTestConnectProxy(c *gocheck.C, tunnels *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt32(tunnels, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		pipe(conn, target)
+	}))
+	return l
+}
+
+// startTestSOCKS5Proxy stands in for a bastion running an unauthenticated SOCKS5 proxy.
+func startTestSOCKS5Proxy(c *gocheck.C, tunnels *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 262)
+				io.ReadFull(conn, buf[:3]) // version, 1 method, no auth
+				conn.Write([]byte{5, 0})
+				io.ReadFull(conn, buf[:5]) // version, connect, reserved, domain, length
+				host := make([]byte, int(buf[4])+2)
+				io.ReadFull(conn, host)
+				port := int(host[len(host)-2])<<8 | int(host[len(host)-1])
+				target, err := net.Dial("tcp", net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(port)))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				atomic.AddInt32(tunnels, 1)
+				conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+				pipe(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func (s *RPCSuite) TestProxies(c *gocheck.C) {
+	_, plain := startTestRPCServer(c)
+	defer plain.Close()
+	dir := c.MkDir()
+	certFile, keyFile, _ := writeTestCert(c, dir, time.Now())
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	c.Assert(err, gocheck.IsNil)
+	secure := startTestTLSRPCServer(c, reloader.TLSConfig())
+	defer secure.Close()
+	// use names rather than addresses so the SOCKS proxy has to resolve them
+	_, plainPort, _ := net.SplitHostPort(plain.Addr().String())
+	_, securePort, _ := net.SplitHostPort(secure.Addr().String())
+	var connectTunnels, socksTunnels int32
+	connect := startTestConnectProxy(c, &connectTunnels)
+	defer connect.Close()
+	socks := startTestSOCKS5Proxy(c, &socksTunnels)
+	defer socks.Close()
+
+	proxies := []struct {
+		url     string
+		tunnels *int32
+	}{
+		{"http://user:pass@" + connect.Addr().String(), &connectTunnels},
+		{"socks5://" + socks.Addr().String(), &socksTunnels},
+	}
+	for _, proxy := range proxies {
+		for _, useTLS := range []bool{false, true} {
+			port := plainPort
+			if useTLS {
+				port = securePort
+			}
+			before := atomic.LoadInt32(proxy.tunnels)
+			opts := ProxiedRPCServerOpts{"localhost:" + port, proxy.url}
+			client := NewRPCClientWithConfig(opts, "Test", "1.0", useTLS)
+			var reply EchoReply
+			c.Assert(client.Call("Echo", EchoArg{"hi"}, &reply), gocheck.IsNil)
+			c.Check(reply.Message, gocheck.Equals, "hi")
+			c.Assert(client.CallWithTimeout("Echo", EchoArg{"again"}, &reply, 5), gocheck.IsNil)
+			c.Check(reply.Message, gocheck.Equals, "again")
+			// one version check plus two calls
+			c.Check(atomic.LoadInt32(proxy.tunnels)-before, gocheck.Equals, int32(3))
+		}
+	}
+
+	opts := ProxiedRPCServerOpts{plain.Addr().String(), "http://" + connect.Addr().String()}
+	client := NewRPCClientWithConfig(opts, "Test", "1.0", false)
+	var reply EchoReply
+	c.Check(client.Call("Echo", EchoArg{"hi"}, &reply), gocheck.ErrorMatches, ".*407 Proxy Authentication Required")
+}
+
+func startTestFramedRPCServer(c *gocheck.C, opts *RPCCodecOpts) net.Listener {
+	server := rpc.NewServer()
+	c.Assert(server.RegisterName("Test", &testRPCServer{}), gocheck.IsNil)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	mux.Handle(DefaultRPCFramedPath, &FramedRPCHandler{server, opts})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	go http.Serve(l, mux)
+	return l
+}
+
+func (s *RPCSuite) TestFramedCodecLimits(c *gocheck.C) {
+	l := startTestFramedRPCServer(c, &RPCCodecOpts{MaxRequestSize: 4096, MaxResponseSize: 8192,
+		CompressThreshold: 1024})
+	defer l.Close()
+	big := strings.Repeat("x", 6000)
+	var reply EchoReply
+
+	// old clients still work next to the framed codec
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	c.Assert(client.Call("Echo", EchoArg{big}, &reply), gocheck.IsNil)
+
+	// the server's request limit is learned during the handshake and enforced before sending
+	client = NewRPCClient(l.Addr().String(), "Test", "1.0", false)
+	client.EnableFramedCodec(NewRPCCodecOpts())
+	c.Assert(client.Call("Echo", EchoArg{"small"}, &reply), gocheck.IsNil)
+	c.Check(reply.Message, gocheck.Equals, "small")
+	err := client.Call("Echo", EchoArg{big}, &reply)
+	c.Assert(err, gocheck.FitsTypeOf, &RPCSizeError{})
+	c.Check(err, gocheck.ErrorMatches, "RPC request for Test.Echo is [0-9]+ bytes, over the 4096 byte limit")
+
+	// responses over the client's limit come back as an error from the server instead
+	client.EnableFramedCodec(&RPCCodecOpts{MaxResponseSize: 2048, CompressThreshold: 1024})
+	c.Check(client.Call("Echo", EchoArg{strings.Repeat("y", 3000)}, &reply), gocheck.ErrorMatches,
+		"RPC response for Test.Echo is [0-9]+ bytes, over the 2048 byte limit")
+	c.Assert(client.Call("Echo", EchoArg{"small"}, &reply), gocheck.IsNil)
+
+	// and the server enforces its request limit even if a client doesn't
+	conn, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, gocheck.IsNil)
+	io.WriteString(conn, "CONNECT "+DefaultRPCFramedPath+" HTTP/1.0\n\n")
+	reader := bufio.NewReader(conn)
+	_, err = http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	c.Assert(err, gocheck.IsNil)
+	codec, err := newRPCClientCodec(conn, reader, &RPCCodecOpts{})
+	c.Assert(err, gocheck.IsNil)
+	codec.(*rpcFramedClientCodec).maxRequestSize = rpcUnlimitedMessage
+	raw := rpc.NewClientWithCodec(codec)
+	defer raw.Close()
+	c.Check(raw.Call("Test.Echo", EchoArg{big}, &reply), gocheck.ErrorMatches,
+		"RPC request for Test.Echo is [0-9]+ bytes, over the 4096 byte limit")
+	c.Assert(raw.Call("Test.Echo", EchoArg{"still works"}, &reply), gocheck.IsNil)
+	c.Check(reply.Message, gocheck.Equals, "still works")
+}
+
+func (s *RPCSuite) TestFramedCodecTLS(c *gocheck.C) {
+	dir := c.MkDir()
+	certFile, keyFile, _ := writeTestCert(c, dir, time.Now())
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	c.Assert(err, gocheck.IsNil)
+	server := rpc.NewServer()
+	c.Assert(server.RegisterName("Test", &testRPCServer{}), gocheck.IsNil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", reloader.TLSConfig())
+	c.Assert(err, gocheck.IsNil)
+	defer l.Close()
+	go ServeFramed(server, l, NewRPCCodecOpts())
+	client := NewRPCClient(l.Addr().String(), "Test", "1.0", true)
+	client.EnableFramedCodec(NewRPCCodecOpts())
+	var reply EchoReply
+	big := strings.Repeat("z", 100000)
+	c.Assert(client.Call("Echo", EchoArg{big}, &reply), gocheck.IsNil)
+	c.Check(reply.Message, gocheck.Equals, big)
+}
+
+func (s *RPCSuite) TestFramedCompression(c *gocheck.C) {
+	var wire bytes.Buffer
+	framer := &rpcFramer{r: bufio.NewReader(&wire), w: bufio.NewWriter(&wire), compress: true, threshold: 1024}
+	payload := []byte(strings.Repeat("compressible ", 1000))
+	c.Assert(framer.writeFrame(payload), gocheck.IsNil)
+	c.Assert(framer.w.Flush(), gocheck.IsNil)
+	c.Check(wire.Len() < len(payload)/10, gocheck.Equals, true)
+	read, size, err := framer.readFrame(len(payload))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(size, gocheck.Equals, len(payload))
+	c.Check(string(read), gocheck.Equals, string(payload))
+
+	// a frame that would inflate past the limit is refused
+	c.Assert(framer.writeFrame(payload), gocheck.IsNil)
+	c.Assert(framer.w.Flush(), gocheck.IsNil)
+	read, _, err = framer.readFrame(1024)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(read, gocheck.IsNil)
+}
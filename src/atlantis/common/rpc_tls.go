@@ -0,0 +1,171 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Server Certificates
+// ----------------------------------------------------------------------------------------------------------
+
+// CertReloader serves a certificate/key pair from disk and picks up new files when they change. Only new
+// handshakes see the new certificate, so connections that are already up are left alone.
+type CertReloader struct {
+	sync.RWMutex
+	CertFile string
+	KeyFile  string
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCertReloader loads the pair and, if interval is positive, checks the files for changes every interval.
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	c := &CertReloader{CertFile: certFile, KeyFile: keyFile, stop: make(chan struct{})}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go c.watch(interval)
+	}
+	return c, nil
+}
+
+func (c *CertReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Reload(); err != nil {
+				// keep serving the old certificate, the new one might just be half written
+				log.Printf("[TLS] could not reload %s: %s", c.CertFile, err.Error())
+			}
+		}
+	}
+}
+
+// Reload loads the pair again if either file changed since the last load.
+func (c *CertReloader) Reload() error {
+	certInfo, err := os.Stat(c.CertFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.RLock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod)
+	c.RUnlock()
+	if unchanged {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	reloaded := c.cert != nil
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	c.Unlock()
+	if reloaded {
+		log.Printf("[TLS] reloaded %s", c.CertFile)
+	}
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// TLSConfig returns a server config that always presents the latest certificate.
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate}
+}
+
+func (c *CertReloader) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// Certificate Pinning
+// ----------------------------------------------------------------------------------------------------------
+
+const spkiPinPrefix = "sha256/"
+
+// RPCServerOpts can implement this to pin the keys an endpoint may present. Pins are base64 SHA-256 hashes
+// of a certificate's SubjectPublicKeyInfo (optionally prefixed by "sha256/"), and the connection is only
+// accepted if the server's own (leaf) certificate matches one of them. The rest of the chain isn't verified,
+// so pinning a CA certificate doesn't work.
+type RPCPinnedServerOpts interface {
+	RPCPinnedKeys() []string
+}
+
+type PinnedRPCServerOpts struct {
+	HostAndPort string
+	Pins        []string
+}
+
+func (o PinnedRPCServerOpts) RPCHostAndPort() string {
+	return o.HostAndPort
+}
+
+func (o PinnedRPCServerOpts) RPCPinnedKeys() []string {
+	return o.Pins
+}
+
+// SPKIHash returns the pin for a certificate.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func verifyPins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinned[strings.TrimPrefix(pin, spkiPinPrefix)] = true
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		// only the leaf is checked against the handshake signature, anyone can append other certificates
+		if len(rawCerts) == 0 {
+			return errors.New("Certificate Pin Mismatch: no certificate presented")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if !pinned[SPKIHash(cert)] {
+			return errors.New("Certificate Pin Mismatch: the presented key doesn't match the pinned keys")
+		}
+		return nil
+	}
+}
@@ -12,9 +12,9 @@
 package common
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"sync"
 	"time"
@@ -23,8 +23,13 @@ import (
 const taskIDSize = 20
 
 var (
-	Tracker           = &TaskTracker{tasks: map[string]*Task{}}
-	TaskStatusUnknown = &TaskStatus{Status: StatusUnknown}
+	Tracker            = NewTaskTracker(TaskTrackerOptions{})
+	TaskStatusUnknown  = &TaskStatus{Status: StatusUnknown}
+	ErrTaskInterrupted = errors.New("Task Interrupted")
+	ErrTaskCancelled   = errors.New("Task Cancelled")
+	ErrTaskTimedOut    = errors.New("Task Timed Out")
+	ErrShuttingDown    = errors.New("Shutting Down")
+	ErrMaintenance     = errors.New("Under Maintenance")
 )
 
 func MaintenanceChecker(file string, interval time.Duration) {
@@ -32,12 +37,28 @@ func MaintenanceChecker(file string, interval time.Duration) {
 }
 
 func NewTask(name string, executor TaskExecutor) *Task {
-	task := &Task{Tracker: Tracker, Executor: executor}
+	return NewTaskOn(Tracker, name, executor)
+}
+
+func NewTaskOn(tracker *TaskTracker, name string, executor TaskExecutor) *Task {
+	task := &Task{Tracker: tracker, Executor: executor}
+	task.ctx, task.cancel = context.WithCancel(context.Background())
 	task.Status = StatusInit
-	task.StatusTime = time.Now()
+	task.StatusTime = tracker.now()
+	task.State = TaskStateNew
+	task.Transitions = []TaskTransition{TaskTransition{TaskStateNew, task.StatusTime}}
 	task.Name = name
 	task.Description = executor.Description()
 	task.Request = executor.Request()
+	if userExecutor, ok := executor.(TaskUserExecutor); ok {
+		task.User = userExecutor.User()
+	}
+	if labelsExecutor, ok := executor.(TaskLabelsExecutor); ok {
+		task.Labels = copyLabels(labelsExecutor.Labels())
+	}
+	if correlatedExecutor, ok := executor.(TaskCorrelatedExecutor); ok {
+		task.CorrelationID = correlatedExecutor.CorrelationID()
+	}
 	return task
 }
 
@@ -45,7 +66,30 @@ type TaskTracker struct {
 	sync.RWMutex
 	ResultDuration time.Duration
 	Maintenance    bool
+	Store          TaskStore
+	Workers        int            // tasks allowed to run at once, 0 for no limit
+	QueueSize      int            // tasks allowed to wait for a worker, 0 for no limit
+	NameLimits     map[string]int // tasks of a given name allowed to run at once
+	Logger         TaskLogger
+	Clock          TaskClock
+	ShutdownGrace  time.Duration // how long Shutdown waits for cancelled tasks, 0 for DefaultShutdownGrace
+	IdempotencyTTL time.Duration // how long idempotency keys are remembered, 0 for ResultDuration
+	LogLines       int           // log lines kept per task, 0 for DefaultTaskLogLines
 	tasks          map[string]*Task
+	queue          []*queuedTask
+	running        int
+	runningByName  map[string]int
+	held           map[string][]heldLock
+	keys           map[string]*idempotentTask
+	stop           chan struct{}
+	stopped        bool
+	panics         uint64
+	shuttingDown   bool
+	overrunning    map[*Task]bool // timed out tasks whose executors are still running
+	watchLock      sync.Mutex
+	watchers       map[*TaskWatcher]bool
+	metricsLock    sync.Mutex
+	metrics        taskMetrics
 }
 
 type Task struct {
@@ -57,6 +101,22 @@ type Task struct {
 	Executor TaskExecutor
 	Request  interface{}
 	Result   interface{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	canceled bool
+	timedOut bool
+	// closed once an executor that outlived its timeout returns
+	executing chan struct{}
+
+	parent     *Task
+	children   []*Task
+	subtasks   sync.WaitGroup
+	subtaskErr error
+	failFast   bool
+	onEnd      func(error)
+
+	logLock sync.Mutex
+	logs    taskLogBuffer
 }
 
 type TaskExecutor interface {
@@ -71,6 +131,13 @@ type TaskMaintenanceExecutor interface {
 	AllowDuringMaintenance() bool
 }
 
+// TaskTimeoutExecutor limits how long Execute may run. Once the timeout passes the task's Context is cancelled
+// and the task ends as TIMED_OUT without waiting for Execute to return. Until it does return the task keeps its
+// worker and resource locks, so nothing else touches those resources alongside it, and Shutdown waits for it.
+type TaskTimeoutExecutor interface {
+	Timeout() time.Duration
+}
+
 func createTaskID() string {
 	return CreateRandomID(taskIDSize)
 }
@@ -91,6 +158,63 @@ func (t *TaskTracker) ListIDs(types []string) []string {
 	return ids
 }
 
+// UseStore persists tasks to store from now on and loads the tasks it already holds. Tasks that were still
+// running when they were saved can't be resumed, so they are marked as interrupted.
+func (t *TaskTracker) UseStore(store TaskStore) error {
+	recs, err := store.Load()
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	t.Store = store
+	t.Unlock()
+	for _, rec := range recs {
+		task := &Task{Tracker: t, ID: rec.ID, TaskStatus: rec.Status, Result: rec.Result}
+		if rec.Err != "" {
+			task.Err = errors.New(rec.Err)
+		}
+		if !task.Done {
+			task.setState(TaskStateInterrupted, t.now())
+			task.Status = StatusInterrupted
+			task.Err = ErrTaskInterrupted
+			task.Done = true
+			task.EndTime = t.now()
+			task.StatusTime = task.EndTime
+			task.Log("Interrupted %s", task.Description)
+		}
+		t.Lock()
+		t.tasks[task.ID] = task
+		t.Unlock()
+		t.persist(task)
+		id := task.ID
+		t.afterFunc(t.ResultDuration, func() {
+			t.ReleaseTaskID(id)
+		})
+	}
+	return nil
+}
+
+func (t *TaskTracker) persist(task *Task) {
+	t.RLock()
+	store := t.Store
+	t.RUnlock()
+	if store == nil {
+		return
+	}
+	task.RLock()
+	rec := &TaskRecord{ID: task.ID, Status: *task.CopyTaskStatus(), Result: task.Result}
+	if task.Err != nil {
+		rec.Err = task.Err.Error()
+	}
+	task.RUnlock()
+	if rec.ID == "" {
+		return
+	}
+	if err := store.Save(rec); err != nil {
+		t.logf(LogError, "[TaskStore] could not save %s: %s", rec.ID, err.Error())
+	}
+}
+
 func (t *TaskTracker) SetMaintenance(on bool) {
 	t.Lock()
 	t.Maintenance = on
@@ -104,22 +228,29 @@ func (t *TaskTracker) UnderMaintenance() bool {
 	return maint
 }
 
+// MaintenanceChecker puts the tracker under maintenance while file exists. It returns once the tracker is
+// stopped.
 func (t *TaskTracker) MaintenanceChecker(file string, interval time.Duration) {
+	stop := t.stopChan()
 	for {
 		if _, err := os.Stat(file); err == nil {
 			// maintenance file exists
 			if !t.UnderMaintenance() {
-				log.Println("Begin Maintenance")
+				t.logf(LogInfo, "Begin Maintenance")
 				t.SetMaintenance(true)
 			}
 		} else {
 			// maintenance file doesn't exist or there is an error looking for it
 			if t.UnderMaintenance() {
-				log.Println("End Maintenance")
+				t.logf(LogInfo, "End Maintenance")
 				t.SetMaintenance(false)
 			}
 		}
-		time.Sleep(interval)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
 	}
 }
 
@@ -147,29 +278,57 @@ func (t *TaskTracker) ReserveTaskID(task *Task) string {
 	task.Lock()
 	task.ID = requestID
 	task.Unlock()
+	t.changed(task, TaskEventCreated)
 	return requestID
 }
 
 func (t *TaskTracker) ReleaseTaskID(id string) {
 	t.Lock()
 	delete(t.tasks, id)
+	store := t.Store
 	t.Unlock()
+	if store != nil {
+		if err := store.Delete(id); err != nil {
+			t.logf(LogError, "[TaskStore] could not delete %s: %s", id, err.Error())
+		}
+	}
 }
 
 func (t *TaskTracker) Status(id string) (*TaskStatus, error) {
 	t.RLock()
 	task := t.tasks[id]
+	position := t.queuePosition(task)
 	t.RUnlock()
 	if task != nil {
 		task.RLock()
 		status := task.CopyTaskStatus()
 		err := task.Err
 		task.RUnlock()
+		status.QueuePosition = position
 		return status, err
 	}
 	return TaskStatusUnknown, errors.New("Unknown Task Status")
 }
 
+// Cancel asks a running task to stop. Executors see it through the task's Context and the task ends as
+// CANCELLED once its executor returns.
+func (t *TaskTracker) Cancel(id string) error {
+	t.RLock()
+	task := t.tasks[id]
+	t.RUnlock()
+	if task == nil {
+		return errors.New("Unknown Task")
+	}
+	if err := task.Cancel(); err != nil {
+		return err
+	}
+	if queued := t.dequeue(task); queued != nil {
+		// never started, so end it the way whoever submitted it expects
+		queued.end(ErrTaskCancelled)
+	}
+	return nil
+}
+
 func (t *TaskTracker) Result(id string) interface{} {
 	t.RLock()
 	task := t.tasks[id]
@@ -187,70 +346,209 @@ func (t *Task) Authorize() error {
 	return t.Executor.Authorize()
 }
 
-func (t *Task) Run() error {
+// admit checks whether the tracker takes new tasks.
+func (t *Task) admit() error {
+	if t.Tracker.ShuttingDown() {
+		return ErrShuttingDown
+	}
 	if t.Tracker.UnderMaintenance() {
 		executor, ok := t.Executor.(TaskMaintenanceExecutor)
 		if !ok || !executor.AllowDuringMaintenance() {
-			return t.End(errors.New("Under Maintenance"), false)
+			return ErrMaintenance
 		}
 	}
+	return nil
+}
+
+func (t *Task) Run() error {
+	if err := t.admit(); err != nil {
+		return t.End(err, false)
+	}
+	if existing := t.Tracker.claimKey(t); existing != nil {
+		return t.adopt(existing)
+	}
 	t.Tracker.ReserveTaskID(t)
-	t.Log("Begin %s", t.Description)
-	t.Lock()
-	t.StartTime = time.Now()
-	t.Unlock()
-	err := t.Executor.Authorize()
-	if err != nil {
+	done := make(chan error, 1)
+	if err := t.Tracker.submit(t, func(err error) { done <- t.End(err, false) }); err != nil {
 		return t.End(err, false)
 	}
-	return t.End(t.Executor.Execute(t), false)
+	return <-done
 }
 
 func (t *Task) RunAsync(r *AsyncReply) error {
-	if t.Tracker.UnderMaintenance() {
-		executor, ok := t.Executor.(TaskMaintenanceExecutor)
-		if !ok || !executor.AllowDuringMaintenance() {
-			return t.End(errors.New("Under Maintenance"), false)
-		}
+	if err := t.admit(); err != nil {
+		return t.End(err, false)
+	}
+	if existing := t.Tracker.claimKey(t); existing != nil {
+		existing.RLock()
+		r.ID = existing.ID
+		r.Existing = existing.CopyTaskStatus()
+		existing.RUnlock()
+		return nil
 	}
 	t.Tracker.ReserveTaskID(t)
+	if err := t.Tracker.submit(t, func(err error) { t.End(err, true) }); err != nil {
+		return t.End(err, false)
+	}
 	t.RLock()
 	r.ID = t.ID
 	t.RUnlock()
-	go func() error {
-		t.Log("Begin %s", t.Description)
+	return nil
+}
+
+func (t *Task) execute() error {
+	t.transition(TaskStateRunning)
+	t.Log("Begin %s", t.Description)
+	t.Lock()
+	t.StartTime = t.Tracker.now()
+	t.Unlock()
+	if err := t.safely(t.Executor.Authorize); err != nil {
+		return err
+	}
+	if err := t.CheckCancelled(); err != nil {
+		return err
+	}
+	executor, ok := t.Executor.(TaskTimeoutExecutor)
+	if !ok || executor.Timeout() <= 0 {
+		return t.executeAttempts()
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), executor.Timeout())
+	t.Lock()
+	parentCancel := t.cancel
+	t.ctx = ctx
+	t.cancel = func() {
+		cancel()
+		parentCancel()
+	}
+	t.Unlock()
+	done := make(chan error, 1)
+	executing := make(chan struct{})
+	go func() {
+		defer close(executing)
+		done <- t.executeAttempts()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		// cancelled, give the executor a chance to clean up
+		return <-done
+	}
+	t.Lock()
+	t.timedOut = true
+	t.executing = executing
+	t.Unlock()
+	t.Tracker.overrun(t, executing)
+	return ErrTaskTimedOut
+}
+
+// overrun keeps track of a timed out task until its executor returns.
+func (t *TaskTracker) overrun(task *Task, executing chan struct{}) {
+	t.Lock()
+	if t.overrunning == nil {
+		t.overrunning = map[*Task]bool{}
+	}
+	t.overrunning[task] = true
+	t.Unlock()
+	go func() {
+		<-executing
 		t.Lock()
-		t.StartTime = time.Now()
+		delete(t.overrunning, task)
 		t.Unlock()
-		err := t.Executor.Authorize()
-		if err != nil {
-			return t.End(err, true)
-		}
-		t.End(t.Executor.Execute(t), true)
-		return nil
 	}()
-	return nil
+}
+
+// overrunning returns a channel that is closed once the task's timed out executor returns, or nil if the
+// executor isn't running past its timeout.
+func (t *Task) overrunning() <-chan struct{} {
+	t.RLock()
+	executing := t.executing
+	t.RUnlock()
+	if executing == nil {
+		return nil
+	}
+	select {
+	case <-executing:
+		return nil
+	default:
+		return executing
+	}
 }
 
 func (t *Task) End(err error, async bool) error {
 	logString := fmt.Sprintf("End %s", t.Description)
 	t.Lock()
-	t.Result = t.Executor.Result()
-	t.EndTime = time.Now()
+	if !t.timedOut {
+		// a timed out executor may still be running, leave it alone
+		t.Result = t.Executor.Result()
+	}
+	t.EndTime = t.Tracker.now()
 	t.StatusTime = t.EndTime
-	if err == nil {
+	state := TaskStateSucceeded
+	if t.timedOut {
+		err = ErrTaskTimedOut
+		state = TaskStateTimedOut
+		t.Status = StatusTimedOut
+		t.Err = err
+		t.Done = true
+		logString += " - Timed Out"
+	} else if t.canceled || (err != nil && t.ctx != nil && t.ctx.Err() == context.Canceled) {
+		// cancelled directly or along with the parent task
+		if err != nil && err != ErrTaskCancelled && err != context.Canceled {
+			logString += fmt.Sprintf(" - Error: %s", err.Error())
+		}
+		err = ErrTaskCancelled
+		state = TaskStateCancelled
+		t.Status = StatusCancelled
+		t.Err = err
+		t.Done = true
+		logString += " - Cancelled"
+	} else if err == nil {
 		t.Status = StatusDone
 		t.Done = true
 	} else {
+		state = TaskStateFailed
 		t.Status = StatusError
 		t.Err = err
 		t.Done = true
 		logString += fmt.Sprintf(" - Error: %s", err.Error())
 	}
+	if len(t.Attempts) > 1 {
+		logString += fmt.Sprintf(" - %d Attempts", len(t.Attempts))
+	}
+	if stateErr := t.setState(state, t.EndTime); stateErr != nil {
+		logString += " - " + stateErr.Error()
+	}
+	started := !t.StartTime.IsZero()
+	duration := t.EndTime.Sub(t.StartTime)
+	name := t.Name
+	cancel := t.cancel
+	parent := t.parent
 	t.Unlock()
-	t.Log(logString)
+	if started {
+		t.Tracker.observe(name, state, duration)
+	} else {
+		t.Tracker.reject(name, err)
+	}
+	if cancel != nil {
+		cancel()
+	}
+	if err != nil && state == TaskStateFailed {
+		t.Logf(LogError, nil, "%s", logString)
+	} else {
+		t.Log("%s", logString)
+	}
+	t.Tracker.changed(t, TaskEventDone)
+	if parent != nil {
+		parent.subtaskEnded(t, err)
+	}
+	if t.onEnd != nil {
+		t.onEnd(err)
+	}
 	if async {
-		time.AfterFunc(t.Tracker.ResultDuration, func() {
+		t.Tracker.afterFunc(t.Tracker.ResultDuration, func() {
 			// keep result around for 30 min in case someone wants to check on it
 			t.Tracker.ReleaseTaskID(t.ID)
 		})
@@ -260,52 +558,136 @@ func (t *Task) End(err error, async bool) error {
 	return err
 }
 
-func (t *Task) Log(format string, args ...interface{}) {
-	t.RLock()
-	log.Printf("[RPC]["+t.Name+"]["+t.ID+"] "+format, args...)
-	t.RUnlock()
+// Context is cancelled when someone cancels the task. Executors should pass it to anything that blocks and
+// check it between steps.
+func (t *Task) Context() context.Context {
+	t.Lock()
+	defer t.Unlock()
+	if t.ctx == nil {
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+	}
+	return t.ctx
+}
+
+func (t *Task) Cancel() error {
+	ctx := t.Context()
+	t.Lock()
+	if t.Done {
+		t.Unlock()
+		return errors.New("Task Already Done")
+	}
+	t.canceled = true
+	cancel := t.cancel
+	t.Unlock()
+	if ctx.Err() == nil {
+		t.Log("Cancelling %s", t.Description)
+	}
+	cancel()
+	return nil
+}
+
+func (t *Task) Cancelled() bool {
+	return t.Context().Err() != nil
 }
 
+// CheckCancelled returns ErrTaskCancelled if the task was cancelled. Call it between steps and return the error.
+func (t *Task) CheckCancelled() error {
+	if t.Cancelled() {
+		return ErrTaskCancelled
+	}
+	return nil
+}
+
+// Sleep waits for d, returning ErrTaskCancelled early if the task is cancelled in the meantime.
+func (t *Task) Sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.Context().Done():
+		return ErrTaskCancelled
+	}
+}
+
+// LogStatus logs a progress message and makes it the task's Status. Once the task is done (say an executor
+// that timed out is still going) the message is only logged.
 func (t *Task) LogStatus(format string, args ...interface{}) {
 	t.Log(format, args...)
 	t.Lock()
-	t.StatusTime = time.Now()
+	if t.Done {
+		t.Unlock()
+		return
+	}
+	t.StatusTime = t.Tracker.now()
 	t.Status = fmt.Sprintf(format, args...)
 	t.Unlock()
+	t.Tracker.changed(t, TaskEventStatus)
 }
 
 func (t *Task) AddWarning(warn string) {
+	t.Logf(LogWarn, nil, "WARNING: %s", warn)
 	t.Lock()
+	if t.Done {
+		t.Unlock()
+		return
+	}
 	if t.Warnings == nil {
 		t.Warnings = []string{warn}
 	} else {
 		t.Warnings = append(t.Warnings, warn)
 	}
 	t.Unlock()
-	t.Log("WARNING: %s", warn)
+	t.Tracker.changed(t, TaskEventWarning)
 }
 
 type TaskStatus struct {
-	Name        string
-	Description string
-	Status      string
-	Warnings    []string
-	Done        bool
-	StartTime   time.Time
-	StatusTime  time.Time
-	EndTime     time.Time
+	Name          string
+	Description   string
+	Status        string
+	Warnings      []string
+	Done          bool
+	StartTime     time.Time
+	StatusTime    time.Time
+	EndTime       time.Time
+	QueuePosition int // 1 for the next task to run, 0 once the task is no longer queued
+	State         TaskState
+	Transitions   []TaskTransition
+	ParentID      string
+	ChildIDs      []string
+	Subtasks      TaskSubtaskSummary
+	Workflow      []WorkflowStepStatus
+	Progress      TaskProgress
+	Version       uint64 // bumped on every change, see TaskTracker.WaitForChange
+	User          string
+	Labels        map[string]string
+	Attempts      []TaskAttempt // only recorded for executors with a retry policy
+	CorrelationID string
 }
 
 func (t *TaskStatus) Map() map[string]interface{} {
 	return map[string]interface{}{
-		"Name":        t.Name,
-		"Description": t.Description,
-		"Status":      t.Status,
-		"Warnings":    t.Warnings,
-		"Done":        t.Done,
-		"StartTime":   t.StartTime,
-		"StatusTime":  t.StatusTime,
-		"EndTime":     t.EndTime,
+		"Name":          t.Name,
+		"Description":   t.Description,
+		"Status":        t.Status,
+		"Warnings":      t.Warnings,
+		"Done":          t.Done,
+		"StartTime":     t.StartTime,
+		"StatusTime":    t.StatusTime,
+		"EndTime":       t.EndTime,
+		"QueuePosition": t.QueuePosition,
+		"State":         t.State,
+		"Transitions":   t.Transitions,
+		"ParentID":      t.ParentID,
+		"ChildIDs":      t.ChildIDs,
+		"Subtasks":      t.Subtasks,
+		"Workflow":      t.Workflow,
+		"Progress":      t.Progress,
+		"Version":       t.Version,
+		"User":          t.User,
+		"Labels":        t.Labels,
+		"Attempts":      t.Attempts,
+		"CorrelationID": t.CorrelationID,
 	}
 }
 
@@ -317,11 +699,41 @@ Warnings    : %v
 Done        : %t
 StartTime   : %s
 StatusTime  : %s
-EndTime     : %s`, t.Name, t.Description, t.Status, t.Warnings, t.Done, t.StartTime, t.StatusTime,
-		t.EndTime)
+EndTime     : %s
+QueuePos    : %d
+State       : %s
+ParentID    : %s
+Subtasks    : %s
+Workflow    : %v
+Progress    : %s
+Version     : %d
+User        : %s
+Labels      : %v
+Attempts    : %d %v
+Correlation : %s`, t.Name, t.Description, t.Status, t.Warnings, t.Done, t.StartTime, t.StatusTime,
+		t.EndTime, t.QueuePosition, t.State, t.ParentID, t.Subtasks, t.Workflow, t.Progress, t.Version, t.User,
+		t.Labels, len(t.Attempts), t.Attempts, t.CorrelationID)
 }
 
 func (t *TaskStatus) CopyTaskStatus() *TaskStatus {
-	return &TaskStatus{t.Name, t.Description, t.Status, t.Warnings, t.Done, t.StartTime, t.StatusTime,
-		t.EndTime}
+	var warnings []string
+	if t.Warnings != nil {
+		warnings = append([]string{}, t.Warnings...)
+	}
+	return &TaskStatus{t.Name, t.Description, t.Status, warnings, t.Done, t.StartTime, t.StatusTime,
+		t.EndTime, t.QueuePosition, t.State, append([]TaskTransition(nil), t.Transitions...), t.ParentID,
+		append([]string(nil), t.ChildIDs...), t.Subtasks, copyWorkflowSteps(t.Workflow), t.Progress,
+		t.Version, t.User, copyLabels(t.Labels), append([]TaskAttempt(nil), t.Attempts...),
+		t.CorrelationID}
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return copied
 }
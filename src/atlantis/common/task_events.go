@@ -0,0 +1,168 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Task Events
+//
+// Every change to a task bumps TaskStatus.Version and is sent to the watchers interested in it. Delivery never
+// blocks the task: a watcher that falls more than TaskWatchBuffer events behind loses the newer ones and
+// should catch up with Status.
+// ----------------------------------------------------------------------------------------------------------
+
+const TaskWatchBuffer = 64
+
+type TaskEventKind string
+
+const (
+	TaskEventCreated TaskEventKind = "created"
+	TaskEventStatus  TaskEventKind = "status"
+	TaskEventWarning TaskEventKind = "warning"
+	TaskEventDone    TaskEventKind = "done"
+)
+
+// TaskEvent carries a copy of the task's status right after the change. Watchers share it, so don't modify it.
+type TaskEvent struct {
+	Kind   TaskEventKind
+	ID     string
+	Status *TaskStatus
+}
+
+type TaskWatcher struct {
+	Events  <-chan TaskEvent
+	events  chan TaskEvent
+	tracker *TaskTracker
+	id      string // "" to watch every task
+	filter  func(TaskEvent) bool
+	dropped int
+	closed  bool
+}
+
+// Watch sends the events of one task until it is done, then closes Events.
+func (t *TaskTracker) Watch(id string) (*TaskWatcher, error) {
+	t.RLock()
+	task := t.tasks[id]
+	t.RUnlock()
+	if task == nil {
+		return nil, errors.New("Unknown Task")
+	}
+	w := t.watch(id, nil)
+	task.RLock()
+	done := task.Done
+	task.RUnlock()
+	if done {
+		w.Close()
+	}
+	return w, nil
+}
+
+// WatchAll sends the events of every task filter returns true for, or all of them if filter is nil. Events
+// stays open until the watcher is closed.
+func (t *TaskTracker) WatchAll(filter func(TaskEvent) bool) *TaskWatcher {
+	return t.watch("", filter)
+}
+
+func (t *TaskTracker) watch(id string, filter func(TaskEvent) bool) *TaskWatcher {
+	events := make(chan TaskEvent, TaskWatchBuffer)
+	w := &TaskWatcher{Events: events, events: events, tracker: t, id: id, filter: filter}
+	t.watchLock.Lock()
+	if t.watchers == nil {
+		t.watchers = map[*TaskWatcher]bool{}
+	}
+	t.watchers[w] = true
+	t.watchLock.Unlock()
+	return w
+}
+
+// Close stops the watcher and closes Events.
+func (w *TaskWatcher) Close() {
+	w.tracker.watchLock.Lock()
+	w.close()
+	w.tracker.watchLock.Unlock()
+}
+
+// must hold the tracker's watch lock
+func (w *TaskWatcher) close() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	delete(w.tracker.watchers, w)
+	close(w.events)
+}
+
+// Dropped returns the number of events the watcher missed because it fell behind.
+func (w *TaskWatcher) Dropped() int {
+	w.tracker.watchLock.Lock()
+	defer w.tracker.watchLock.Unlock()
+	return w.dropped
+}
+
+// WaitForChange waits up to timeout for the task's Version to pass sinceVersion and returns its status. It
+// returns right away if the task already changed or is done, and returns the unchanged status on timeout.
+func (t *TaskTracker) WaitForChange(id string, sinceVersion uint64, timeout time.Duration) (*TaskStatus, error) {
+	w, err := t.Watch(id)
+	if err != nil {
+		return TaskStatusUnknown, err
+	}
+	defer w.Close()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		status, err := t.Status(id)
+		if status == TaskStatusUnknown || status.Done || status.Version > sinceVersion {
+			return status, err
+		}
+		select {
+		case _, ok := <-w.Events:
+			if !ok {
+				return t.Status(id)
+			}
+		case <-timer.C:
+			return status, err
+		}
+	}
+}
+
+// changed bumps the task's version, saves it and lets the watchers know.
+func (t *TaskTracker) changed(task *Task, kind TaskEventKind) {
+	task.Lock()
+	task.Version++
+	id := task.ID
+	status := task.CopyTaskStatus()
+	task.Unlock()
+	t.persist(task)
+	if id == "" {
+		return
+	}
+	event := TaskEvent{kind, id, status}
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+	for w := range t.watchers {
+		if (w.id != "" && w.id != id) || (w.filter != nil && !w.filter(event)) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			w.dropped++
+		}
+		if w.id != "" && kind == TaskEventDone {
+			w.close()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Task HTTP Handler
+//
+// HTTPHandler serves a tracker's tasks relative to wherever it is mounted (use http.StripPrefix):
+//
+//   /            HTML page with the running, queued and recently finished tasks
+//   /tasks       JSON list, filtered by the name, state and user parameters and paged with offset and limit
+//   /tasks/<id>  JSON status of one task
+//
+// Tasks are encoded with TaskStatus.Map plus their ID and error.
+// ----------------------------------------------------------------------------------------------------------
+
+// DashboardRecentTasks is how many finished tasks the HTML page shows.
+const DashboardRecentTasks = 50
+
+func (t *TaskTracker) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.Trim(r.URL.Path, "/")
+		switch {
+		case path == "":
+			t.serveDashboard(w)
+		case path == "tasks":
+			t.serveTaskList(w, r)
+		case strings.HasPrefix(path, "tasks/"):
+			t.serveTask(w, strings.TrimPrefix(path, "tasks/"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func taskJSON(id string, status *TaskStatus, err error) map[string]interface{} {
+	m := status.Map()
+	m["ID"] = id
+	if err != nil {
+		m["Error"] = err.Error()
+	}
+	return m
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (t *TaskTracker) serveTask(w http.ResponseWriter, id string) {
+	status, err := t.Status(id)
+	if status == TaskStatusUnknown {
+		writeJSON(w, http.StatusNotFound, map[string]string{"Error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, taskJSON(id, status, err))
+}
+
+func (t *TaskTracker) serveTaskList(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := TaskQuery{Names: params["name"], User: params.Get("user"), SortBy: TaskSortCreated,
+		Descending: true}
+	for _, state := range params["state"] {
+		query.States = append(query.States, TaskState(state))
+	}
+	var err error
+	if offset := params.Get("offset"); offset != "" {
+		if query.Offset, err = strconv.Atoi(offset); err != nil || query.Offset < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "Invalid offset: " + offset})
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "Invalid limit: " + limit})
+			return
+		}
+	}
+	summaries, total := t.Query(query)
+	tasks := make([]map[string]interface{}, len(summaries))
+	for i, summary := range summaries {
+		tasks[i] = taskJSON(summary.ID, summary.TaskStatus, summary.Err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"Tasks": tasks, "Total": total})
+}
+
+type dashboardData struct {
+	Maintenance bool
+	Running     []TaskSummary
+	Queued      []TaskSummary
+	Recent      []TaskSummary
+	Now         time.Time
+}
+
+func (t *TaskTracker) serveDashboard(w http.ResponseWriter) {
+	data := dashboardData{Maintenance: t.UnderMaintenance(), Now: t.now()}
+	data.Running, _ = t.Query(TaskQuery{States: []TaskState{TaskStateRunning}})
+	data.Queued, _ = t.Query(TaskQuery{States: []TaskState{TaskStateQueued}})
+	data.Recent, _ = t.Query(TaskQuery{States: []TaskState{TaskStateSucceeded, TaskStateFailed,
+		TaskStateCancelled, TaskStateTimedOut, TaskStateInterrupted}, SortBy: TaskSortUpdated, Descending: true,
+		Limit: DashboardRecentTasks})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		t.logf(LogError, "[HTTP] could not render task dashboard: %s", err.Error())
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Tasks</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.maintenance { background: #fd8; padding: 8px; }
+.failed, .timed_out, .interrupted { color: #b00; }
+.warning { color: #a60; }
+</style>
+</head>
+<body>
+{{if .Maintenance}}<p class="maintenance">Under Maintenance</p>{{end}}
+{{define "tasks"}}
+{{if .}}
+<table>
+<tr><th>ID</th><th>Name</th><th>Description</th><th>State</th><th>Status</th><th>Updated</th><th>Warnings</th></tr>
+{{range .}}
+<tr class="{{.State}}">
+<td><a href="tasks/{{.ID}}">{{.ID}}</a></td>
+<td>{{.Name}}</td>
+<td>{{.Description}}</td>
+<td>{{.State}}</td>
+<td>{{.Status}}</td>
+<td>{{.StatusTime.Format "2006-01-02 15:04:05"}}</td>
+<td>{{range .Warnings}}<div class="warning">{{.}}</div>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>None</p>
+{{end}}
+{{end}}
+<h2>Running ({{len .Running}})</h2>
+{{template "tasks" .Running}}
+<h2>Queued ({{len .Queued}})</h2>
+{{template "tasks" .Queued}}
+<h2>Recent ({{len .Recent}})</h2>
+{{template "tasks" .Recent}}
+<p>Generated {{.Now.Format "2006-01-02 15:04:05 MST"}}</p>
+</body>
+</html>
+`))
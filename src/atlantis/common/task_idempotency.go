@@ -0,0 +1,81 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"time"
+)
+
+// TaskIdempotentExecutor lets clients retry a submission safely. A task submitted with the same name and key
+// as one submitted less than IdempotencyTTL ago doesn't run. RunAsync replies with the earlier task's ID
+// and status instead, Run waits for the earlier task and returns its outcome. Since tasks are only tracked
+// until their result is released, the window can't outlast ResultDuration. An empty key opts out.
+type TaskIdempotentExecutor interface {
+	IdempotencyKey() string
+}
+
+type idempotentTask struct {
+	task    *Task
+	expires time.Time
+}
+
+// claimKey records task under its idempotency key, or returns the task that already holds the key.
+func (t *TaskTracker) claimKey(task *Task) *Task {
+	executor, ok := task.Executor.(TaskIdempotentExecutor)
+	if !ok || executor.IdempotencyKey() == "" {
+		return nil
+	}
+	key := task.Name + "/" + executor.IdempotencyKey()
+	now := t.now()
+	t.Lock()
+	defer t.Unlock()
+	if t.keys == nil {
+		t.keys = map[string]*idempotentTask{}
+	}
+	for k, claimed := range t.keys {
+		if now.After(claimed.expires) || !t.tracked(claimed.task) {
+			delete(t.keys, k)
+		}
+	}
+	if claimed, present := t.keys[key]; present {
+		return claimed.task
+	}
+	window := t.IdempotencyTTL
+	if window <= 0 {
+		window = t.ResultDuration
+	}
+	t.keys[key] = &idempotentTask{task, now.Add(window)}
+	return nil
+}
+
+// must hold the lock (or the read lock)
+func (t *TaskTracker) tracked(task *Task) bool {
+	task.RLock()
+	id := task.ID
+	task.RUnlock()
+	// tasks that haven't reserved an ID yet are about to
+	return id == "" || t.tasks[id] == task
+}
+
+// adopt makes t a stand-in for the task that claimed its idempotency key once that task is done.
+func (t *Task) adopt(existing *Task) error {
+	t.Tracker.waitForTasks([]*Task{existing}, nil)
+	existing.RLock()
+	status := existing.CopyTaskStatus()
+	id, result, err := existing.ID, existing.Result, existing.Err
+	existing.RUnlock()
+	t.Lock()
+	t.TaskStatus = *status
+	t.ID, t.Result, t.Err = id, result, err
+	t.Unlock()
+	return err
+}
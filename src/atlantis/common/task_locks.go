@@ -0,0 +1,126 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+// ----------------------------------------------------------------------------------------------------------
+// Resource Locks
+//
+// Executors that touch shared resources (an app, an app/sha/env, ...) name them with TaskResourceExecutor. A
+// task only starts once it holds all of its locks. Exclusive locks conflict with every other lock on the same
+// key, shared locks only with exclusive ones. A conflicting task either waits in the task queue or is
+// rejected with a TaskResourceConflictError. Subtasks run under their parent's locks. Locks are released once
+// the executor returns, which for a timed out task can be well after it ended.
+// ----------------------------------------------------------------------------------------------------------
+
+type TaskResourceLock struct {
+	Key    string
+	Shared bool
+}
+
+type TaskResourceExecutor interface {
+	Resources() []TaskResourceLock
+	WaitForResources() bool // false to reject the task if its resources are taken
+}
+
+type TaskResourceConflictError struct {
+	Key    string
+	TaskID string
+}
+
+func (e *TaskResourceConflictError) Error() string {
+	return "Resource " + e.Key + " Locked by Task " + e.TaskID
+}
+
+type heldLock struct {
+	task   *Task
+	shared bool
+}
+
+func (l TaskResourceLock) conflicts(other TaskResourceLock) bool {
+	return l.Key == other.Key && !(l.Shared && other.Shared)
+}
+
+func locksConflict(locks, others []TaskResourceLock) bool {
+	for _, lock := range locks {
+		for _, other := range others {
+			if lock.conflicts(other) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func taskResources(task *Task) ([]TaskResourceLock, bool) {
+	executor, ok := task.Executor.(TaskResourceExecutor)
+	if !ok {
+		return nil, false
+	}
+	return executor.Resources(), executor.WaitForResources()
+}
+
+// must hold the lock (or the read lock)
+func (t *TaskTracker) heldConflict(locks []TaskResourceLock) (string, *Task) {
+	for _, lock := range locks {
+		for _, held := range t.held[lock.Key] {
+			if lock.conflicts(TaskResourceLock{lock.Key, held.shared}) {
+				return lock.Key, held.task
+			}
+		}
+	}
+	return "", nil
+}
+
+// must hold the lock (or the read lock)
+func (t *TaskTracker) queuedConflict(locks []TaskResourceLock) (string, *Task) {
+	for _, queued := range t.queue {
+		for _, lock := range locks {
+			for _, other := range queued.locks {
+				if lock.conflicts(other) {
+					return lock.Key, queued.task
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// must hold the lock
+func (t *TaskTracker) acquire(task *Task, locks []TaskResourceLock) {
+	if len(locks) == 0 {
+		return
+	}
+	if t.held == nil {
+		t.held = map[string][]heldLock{}
+	}
+	for _, lock := range locks {
+		t.held[lock.Key] = append(t.held[lock.Key], heldLock{task, lock.Shared})
+	}
+}
+
+// must hold the lock
+func (t *TaskTracker) release(task *Task, locks []TaskResourceLock) {
+	for _, lock := range locks {
+		holders := t.held[lock.Key]
+		for i, held := range holders {
+			if held.task == task {
+				holders = append(holders[:i], holders[i+1:]...)
+				break
+			}
+		}
+		if len(holders) == 0 {
+			delete(t.held, lock.Key)
+		} else {
+			t.held[lock.Key] = holders
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Task Logging
+//
+// Everything a TaskTracker and its tasks log goes through its TaskLogger. Task logs carry the task's ID, name,
+// user and correlation ID as fields.
+// ----------------------------------------------------------------------------------------------------------
+
+type TaskLogLevel int
+
+const (
+	LogDebug TaskLogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l TaskLogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+const (
+	LogFieldTaskID        = "task_id"
+	LogFieldTaskName      = "task_name"
+	LogFieldUser          = "user"
+	LogFieldCorrelationID = "correlation_id"
+)
+
+type TaskLogFields map[string]interface{}
+
+type TaskLogger interface {
+	Log(level TaskLogLevel, msg string, fields TaskLogFields)
+}
+
+// TaskCorrelatedExecutor ties a task's logs to the request that caused it, possibly across services.
+// Subtasks inherit their parent's correlation ID.
+type TaskCorrelatedExecutor interface {
+	CorrelationID() string
+}
+
+// TextTaskLogger logs lines like "[RPC][name][id] msg key=value".
+type TextTaskLogger struct {
+	Logger   *log.Logger // nil for the standard logger
+	MinLevel TaskLogLevel
+}
+
+func NewTextTaskLogger(logger *log.Logger, minLevel TaskLogLevel) *TextTaskLogger {
+	return &TextTaskLogger{logger, minLevel}
+}
+
+func (l *TextTaskLogger) Log(level TaskLogLevel, msg string, fields TaskLogFields) {
+	if level < l.MinLevel {
+		return
+	}
+	line := msg
+	if name, ok := fields[LogFieldTaskName]; ok {
+		line = fmt.Sprintf("[RPC][%v][%v] %s", name, fields[LogFieldTaskID], msg)
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != LogFieldTaskName && key != LogFieldTaskID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line += fmt.Sprintf(" %s=%v", key, fields[key])
+	}
+	if l.Logger == nil {
+		log.Print(line)
+	} else {
+		l.Logger.Print(line)
+	}
+}
+
+// JSONTaskLogger writes one JSON object per line with the time, level, message and fields.
+type JSONTaskLogger struct {
+	sync.Mutex
+	Writer   io.Writer
+	MinLevel TaskLogLevel
+}
+
+func NewJSONTaskLogger(writer io.Writer, minLevel TaskLogLevel) *JSONTaskLogger {
+	return &JSONTaskLogger{Writer: writer, MinLevel: minLevel}
+}
+
+func (l *JSONTaskLogger) Log(level TaskLogLevel, msg string, fields TaskLogFields) {
+	if level < l.MinLevel {
+		return
+	}
+	entry := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": level.String(), "msg": msg, "error": err.Error()})
+	}
+	l.Lock()
+	l.Writer.Write(append(line, '\n'))
+	l.Unlock()
+}
+
+func (t *TaskTracker) logf(level TaskLogLevel, format string, args ...interface{}) {
+	t.logger().Log(level, fmt.Sprintf(format, args...), nil)
+}
+
+func (t *TaskTracker) logger() TaskLogger {
+	if t.Logger == nil {
+		return defaultTaskLogger
+	}
+	return t.Logger
+}
+
+var defaultTaskLogger = NewTextTaskLogger(nil, LogDebug)
+
+// Logf logs at level with the task's fields and any extra ones.
+func (t *Task) Logf(level TaskLogLevel, fields TaskLogFields, format string, args ...interface{}) {
+	t.RLock()
+	all := TaskLogFields{LogFieldTaskID: t.ID, LogFieldTaskName: t.Name}
+	if t.User != "" {
+		all[LogFieldUser] = t.User
+	}
+	if t.CorrelationID != "" {
+		all[LogFieldCorrelationID] = t.CorrelationID
+	}
+	t.RUnlock()
+	for key, value := range fields {
+		all[key] = value
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	t.capture(level, msg)
+	t.Tracker.logger().Log(level, msg, all)
+}
+
+func (t *Task) Log(format string, args ...interface{}) {
+	t.Logf(LogInfo, nil, format, args...)
+}
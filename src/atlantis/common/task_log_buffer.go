@@ -0,0 +1,116 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultTaskLogLines is how many log lines a task keeps if its tracker doesn't say otherwise.
+const DefaultTaskLogLines = 1000
+
+// TaskLogLine is a line a task logged. Seq counts every line the task ever logged, so it keeps increasing
+// after older lines are dropped from the buffer.
+type TaskLogLine struct {
+	Seq   int
+	Time  time.Time
+	Level TaskLogLevel
+	Msg   string
+}
+
+// taskLogBuffer is a ring buffer of a task's most recent log lines.
+type taskLogBuffer struct {
+	lines []TaskLogLine
+	first int // index of the oldest line in lines
+	count int
+	seq   int // Seq of the next line
+}
+
+func (b *taskLogBuffer) add(size int, line TaskLogLine) {
+	if b.lines == nil {
+		b.lines = make([]TaskLogLine, size)
+	}
+	line.Seq = b.seq
+	b.seq++
+	if b.count < len(b.lines) {
+		b.lines[(b.first+b.count)%len(b.lines)] = line
+		b.count++
+		return
+	}
+	b.lines[b.first] = line
+	b.first = (b.first + 1) % len(b.lines)
+}
+
+// since returns up to limit lines starting at Seq offset, or at the oldest line still kept.
+func (b *taskLogBuffer) since(offset, limit int) []TaskLogLine {
+	oldest := b.seq - b.count
+	if offset < oldest {
+		offset = oldest
+	}
+	n := b.seq - offset
+	if n < 0 {
+		n = 0
+	}
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	lines := make([]TaskLogLine, n)
+	for i := range lines {
+		lines[i] = b.lines[(b.first+offset-oldest+i)%len(b.lines)]
+	}
+	return lines
+}
+
+// capture keeps a line in the task's log buffer.
+func (t *Task) capture(level TaskLogLevel, msg string) {
+	size := t.Tracker.LogLines
+	if size <= 0 {
+		size = DefaultTaskLogLines
+	}
+	now := t.Tracker.now()
+	t.logLock.Lock()
+	t.logs.add(size, TaskLogLine{Time: now, Level: level, Msg: msg})
+	t.logLock.Unlock()
+}
+
+// Logs returns up to limit (0 for no limit) log lines of a task starting at Seq offset, along with the offset
+// to ask for next. Lines that were already dropped are skipped.
+func (t *TaskTracker) Logs(id string, offset, limit int) ([]TaskLogLine, int, error) {
+	t.RLock()
+	task := t.tasks[id]
+	t.RUnlock()
+	if task == nil {
+		return nil, offset, errors.New("Unknown Task")
+	}
+	task.logLock.Lock()
+	defer task.logLock.Unlock()
+	lines := task.logs.since(offset, limit)
+	next := task.logs.seq
+	if len(lines) > 0 {
+		next = lines[len(lines)-1].Seq + 1
+	}
+	return lines, next, nil
+}
+
+// TailLogs returns the last n log lines of a task.
+func (t *TaskTracker) TailLogs(id string, n int) ([]TaskLogLine, error) {
+	t.RLock()
+	task := t.tasks[id]
+	t.RUnlock()
+	if task == nil {
+		return nil, errors.New("Unknown Task")
+	}
+	task.logLock.Lock()
+	defer task.logLock.Unlock()
+	return task.logs.since(task.logs.seq-n, 0), nil
+}
@@ -0,0 +1,247 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Task Metrics
+//
+// A TaskTracker counts finished tasks and how long they ran by name and outcome (the state they ended in).
+// Tasks that end before they start are counted separately by why they didn't start. MetricsHandler serves
+// those along with the current number of running and queued tasks in the Prometheus text format.
+// ----------------------------------------------------------------------------------------------------------
+
+const taskMetricsPrefix = "atlantis_"
+
+// TaskDurationBuckets are the upper bounds, in seconds, of the task duration histogram buckets.
+var TaskDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+type taskMetricKey struct {
+	name    string
+	outcome TaskState
+}
+
+type taskHistogram struct {
+	buckets []uint64 // not cumulative, the last one is +Inf
+	sum     float64
+	count   uint64
+}
+
+type taskRejectKey struct {
+	name   string
+	reason string
+}
+
+type taskMetrics struct {
+	durations map[taskMetricKey]*taskHistogram
+	rejected  map[taskRejectKey]uint64
+}
+
+// observe records a task that ran and ended.
+func (t *TaskTracker) observe(name string, outcome TaskState, duration time.Duration) {
+	t.metricsLock.Lock()
+	defer t.metricsLock.Unlock()
+	if t.metrics.durations == nil {
+		t.metrics.durations = map[taskMetricKey]*taskHistogram{}
+	}
+	key := taskMetricKey{name, outcome}
+	histogram := t.metrics.durations[key]
+	if histogram == nil {
+		histogram = &taskHistogram{buckets: make([]uint64, len(TaskDurationBuckets)+1)}
+		t.metrics.durations[key] = histogram
+	}
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(TaskDurationBuckets, seconds)
+	histogram.buckets[i]++
+	histogram.sum += seconds
+	histogram.count++
+}
+
+// reject records a task that ended before it started.
+func (t *TaskTracker) reject(name string, err error) {
+	t.metricsLock.Lock()
+	defer t.metricsLock.Unlock()
+	if t.metrics.rejected == nil {
+		t.metrics.rejected = map[taskRejectKey]uint64{}
+	}
+	t.metrics.rejected[taskRejectKey{name, rejectReason(err)}]++
+}
+
+func rejectReason(err error) string {
+	switch err.(type) {
+	case *TaskQueueFullError:
+		return "queue_full"
+	case *TaskResourceConflictError:
+		return "resource_conflict"
+	}
+	switch err {
+	case ErrShuttingDown:
+		return "shutting_down"
+	case ErrMaintenance:
+		return "maintenance"
+	case ErrTaskCancelled:
+		return "cancelled"
+	}
+	return "other"
+}
+
+// MetricsHandler serves the tracker's metrics in the Prometheus text format.
+func (t *TaskTracker) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(t.Metrics())
+	})
+}
+
+// Metrics returns the tracker's metrics in the Prometheus text format.
+func (t *TaskTracker) Metrics() []byte {
+	t.RLock()
+	tasks := make([]*Task, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		tasks = append(tasks, task)
+	}
+	queued := len(t.queue)
+	maintenance := t.Maintenance
+	t.RUnlock()
+	running := map[string]int{}
+	for _, task := range tasks {
+		task.RLock()
+		if task.State == TaskStateRunning {
+			running[task.Name]++
+		}
+		task.RUnlock()
+	}
+
+	t.metricsLock.Lock()
+	keys := make([]taskMetricKey, 0, len(t.metrics.durations))
+	histograms := make(map[taskMetricKey]taskHistogram, len(t.metrics.durations))
+	for key, histogram := range t.metrics.durations {
+		keys = append(keys, key)
+		copied := *histogram
+		copied.buckets = append([]uint64(nil), histogram.buckets...)
+		histograms[key] = copied
+	}
+	rejectKeys := make([]taskRejectKey, 0, len(t.metrics.rejected))
+	rejected := make(map[taskRejectKey]uint64, len(t.metrics.rejected))
+	for key, count := range t.metrics.rejected {
+		rejectKeys = append(rejectKeys, key)
+		rejected[key] = count
+	}
+	t.metricsLock.Unlock()
+	sort.Sort(taskMetricKeys(keys))
+	sort.Sort(taskRejectKeys(rejectKeys))
+
+	var buf bytes.Buffer
+	metricHeader(&buf, "tasks_total", "counter", "Tasks that ended, by name and outcome.")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%stasks_total{name=%s,outcome=%s} %d\n", taskMetricsPrefix, metricLabel(key.name),
+			metricLabel(string(key.outcome)), histograms[key].count)
+	}
+	metricHeader(&buf, "task_duration_seconds", "histogram", "How long tasks ran, by name and outcome.")
+	for _, key := range keys {
+		histogram := histograms[key]
+		labels := fmt.Sprintf("name=%s,outcome=%s", metricLabel(key.name), metricLabel(string(key.outcome)))
+		cumulative := uint64(0)
+		for i, count := range histogram.buckets {
+			cumulative += count
+			le := "+Inf"
+			if i < len(TaskDurationBuckets) {
+				le = strconv.FormatFloat(TaskDurationBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(&buf, "%stask_duration_seconds_bucket{%s,le=\"%s\"} %d\n", taskMetricsPrefix, labels, le,
+				cumulative)
+		}
+		fmt.Fprintf(&buf, "%stask_duration_seconds_sum{%s} %s\n", taskMetricsPrefix, labels,
+			strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(&buf, "%stask_duration_seconds_count{%s} %d\n", taskMetricsPrefix, labels, histogram.count)
+	}
+	metricHeader(&buf, "tasks_rejected_total", "counter",
+		"Tasks that ended before they started, by name and reason.")
+	for _, key := range rejectKeys {
+		fmt.Fprintf(&buf, "%stasks_rejected_total{name=%s,reason=%s} %d\n", taskMetricsPrefix,
+			metricLabel(key.name), metricLabel(key.reason), rejected[key])
+	}
+	metricHeader(&buf, "tasks_running", "gauge", "Tasks running right now, by name.")
+	names := make([]string, 0, len(running))
+	for name := range running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%stasks_running{name=%s} %d\n", taskMetricsPrefix, metricLabel(name), running[name])
+	}
+	metricHeader(&buf, "tasks_queued", "gauge", "Tasks waiting for a worker or a resource lock.")
+	fmt.Fprintf(&buf, "%stasks_queued %d\n", taskMetricsPrefix, queued)
+	metricHeader(&buf, "task_panics_total", "counter", "Executor panics recovered.")
+	fmt.Fprintf(&buf, "%stask_panics_total %d\n", taskMetricsPrefix, t.RecoveredPanics())
+	metricHeader(&buf, "maintenance", "gauge", "1 while under maintenance.")
+	if maintenance {
+		fmt.Fprintf(&buf, "%smaintenance 1\n", taskMetricsPrefix)
+	} else {
+		fmt.Fprintf(&buf, "%smaintenance 0\n", taskMetricsPrefix)
+	}
+	return buf.Bytes()
+}
+
+func metricHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s%s %s\n# TYPE %s%s %s\n", taskMetricsPrefix, name, help, taskMetricsPrefix, name,
+		typ)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabel(value string) string {
+	return `"` + metricLabelEscaper.Replace(value) + `"`
+}
+
+type taskMetricKeys []taskMetricKey
+
+func (k taskMetricKeys) Len() int {
+	return len(k)
+}
+
+func (k taskMetricKeys) Swap(i, j int) {
+	k[i], k[j] = k[j], k[i]
+}
+
+func (k taskMetricKeys) Less(i, j int) bool {
+	if k[i].name != k[j].name {
+		return k[i].name < k[j].name
+	}
+	return k[i].outcome < k[j].outcome
+}
+
+type taskRejectKeys []taskRejectKey
+
+func (k taskRejectKeys) Len() int {
+	return len(k)
+}
+
+func (k taskRejectKeys) Swap(i, j int) {
+	k[i], k[j] = k[j], k[i]
+}
+
+func (k taskRejectKeys) Less(i, j int) bool {
+	if k[i].name != k[j].name {
+		return k[i].name < k[j].name
+	}
+	return k[i].reason < k[j].reason
+}
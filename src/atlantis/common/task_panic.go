@@ -0,0 +1,48 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// TaskPanicError is what a task fails with when its executor panics. The stack is logged when the panic is
+// recovered and kept here, but left out of the message.
+type TaskPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *TaskPanicError) Error() string {
+	return fmt.Sprintf("Task Panicked: %v", e.Value)
+}
+
+// RecoveredPanics returns how many executor panics the tracker has turned into task errors.
+func (t *TaskTracker) RecoveredPanics() uint64 {
+	return atomic.LoadUint64(&t.panics)
+}
+
+// safely calls an executor method, turning a panic into a TaskPanicError.
+func (t *Task) safely(call func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &TaskPanicError{r, debug.Stack()}
+			err = panicErr
+			atomic.AddUint64(&t.Tracker.panics, 1)
+			t.Logf(LogError, nil, "Recovered Panic: %v\n%s", r, panicErr.Stack)
+			t.AddWarning(fmt.Sprintf("Recovered Panic: %v", r))
+		}
+	}()
+	return call()
+}
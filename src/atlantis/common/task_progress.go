@@ -0,0 +1,92 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+// TaskProgress is progress in a form UIs can draw. Steps are counted from 1, a zero ETA means it is unknown.
+type TaskProgress struct {
+	Step      string
+	StepIndex int
+	StepTotal int
+	Percent   float64
+	ETA       time.Time
+}
+
+func (p TaskProgress) String() string {
+	str := fmt.Sprintf("%.0f%%", p.Percent)
+	if p.StepTotal > 0 {
+		str = fmt.Sprintf("step %d/%d %s, %s", p.StepIndex, p.StepTotal, p.Step, str)
+	} else if p.Step != "" {
+		str = p.Step + ", " + str
+	}
+	if !p.ETA.IsZero() {
+		str += ", ETA " + p.ETA.Format(time.RFC3339)
+	}
+	return str
+}
+
+// SetStep moves the task to step index of total and sets Percent to the share of steps already finished.
+func (t *Task) SetStep(index, total int, name string) {
+	t.Log("Step %d/%d: %s", index, total, name)
+	t.updateProgress(func(p *TaskProgress) {
+		p.Step = name
+		p.StepIndex = index
+		p.StepTotal = total
+		if total > 0 && index > 0 {
+			p.Percent = clampPercent(float64(index-1) * 100 / float64(total))
+		}
+	})
+}
+
+// SetPercent sets how much of the task is done, from 0 to 100.
+func (t *Task) SetPercent(percent float64) {
+	t.updateProgress(func(p *TaskProgress) {
+		p.Percent = clampPercent(percent)
+	})
+}
+
+// SetETA sets when the task is expected to finish. A remaining duration of 0 or less clears it.
+func (t *Task) SetETA(remaining time.Duration) {
+	t.updateProgress(func(p *TaskProgress) {
+		if remaining <= 0 {
+			p.ETA = time.Time{}
+		} else {
+			p.ETA = t.Tracker.now().Add(remaining)
+		}
+	})
+}
+
+// updateProgress leaves tasks that are already done alone.
+func (t *Task) updateProgress(update func(p *TaskProgress)) {
+	t.Lock()
+	if t.Done {
+		t.Unlock()
+		return
+	}
+	update(&t.Progress)
+	t.StatusTime = t.Tracker.now()
+	t.Unlock()
+	t.Tracker.changed(t, TaskEventStatus)
+}
+
+func clampPercent(percent float64) float64 {
+	if percent < 0 {
+		return 0
+	} else if percent > 100 {
+		return 100
+	}
+	return percent
+}
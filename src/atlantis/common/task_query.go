@@ -0,0 +1,159 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"sort"
+	"time"
+)
+
+// TaskUserExecutor records who asked for a task so it can be searched for.
+type TaskUserExecutor interface {
+	User() string
+}
+
+// TaskLabelsExecutor attaches labels (app, env, ...) to a task so it can be searched for.
+type TaskLabelsExecutor interface {
+	Labels() map[string]string
+}
+
+type TaskSortField string
+
+const (
+	TaskSortCreated TaskSortField = "created" // default
+	TaskSortUpdated TaskSortField = "updated"
+	TaskSortName    TaskSortField = "name"
+)
+
+// TaskQuery selects tasks. Empty fields match everything, Labels have to all match. Since and Until bound
+// StatusTime, which is when the task last changed, so finished tasks are matched by when they ended.
+type TaskQuery struct {
+	Names      []string
+	States     []TaskState
+	Since      time.Time
+	Until      time.Time
+	User       string
+	Labels     map[string]string
+	SortBy     TaskSortField
+	Descending bool
+	Offset     int // negative counts as 0
+	Limit      int // 0 (or negative) for no limit
+}
+
+type TaskSummary struct {
+	ID  string
+	Err error // the task's error, taken along with its status
+	*TaskStatus
+}
+
+// Query returns a page of the tasks matching q along with how many matched in total.
+func (t *TaskTracker) Query(q TaskQuery) ([]TaskSummary, int) {
+	names := make(map[string]bool, len(q.Names))
+	for _, name := range q.Names {
+		names[name] = true
+	}
+	states := make(map[TaskState]bool, len(q.States))
+	for _, state := range q.States {
+		states[state] = true
+	}
+	t.RLock()
+	tasks := make([]*Task, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		tasks = append(tasks, task)
+	}
+	t.RUnlock()
+	matched := []TaskSummary{}
+	for _, task := range tasks {
+		task.RLock()
+		status := task.CopyTaskStatus()
+		id := task.ID
+		err := task.Err
+		task.RUnlock()
+		if (len(names) > 0 && !names[status.Name]) || (len(states) > 0 && !states[status.State]) ||
+			(!q.Since.IsZero() && status.StatusTime.Before(q.Since)) ||
+			(!q.Until.IsZero() && status.StatusTime.After(q.Until)) ||
+			(q.User != "" && status.User != q.User) {
+			continue
+		}
+		labelsMatch := true
+		for key, value := range q.Labels {
+			if status.Labels[key] != value {
+				labelsMatch = false
+				break
+			}
+		}
+		if labelsMatch {
+			matched = append(matched, TaskSummary{id, err, status})
+		}
+	}
+	sort.Sort(&taskSummarySorter{matched, q.SortBy, q.Descending})
+	total := len(matched)
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	if q.Limit < 0 {
+		q.Limit = 0
+	}
+	if q.Offset >= total {
+		return []TaskSummary{}, total
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	return matched, total
+}
+
+type taskSummarySorter struct {
+	summaries  []TaskSummary
+	by         TaskSortField
+	descending bool
+}
+
+func (s *taskSummarySorter) Len() int {
+	return len(s.summaries)
+}
+
+func (s *taskSummarySorter) Swap(i, j int) {
+	s.summaries[i], s.summaries[j] = s.summaries[j], s.summaries[i]
+}
+
+func (s *taskSummarySorter) Less(i, j int) bool {
+	if s.descending {
+		i, j = j, i
+	}
+	a, b := s.summaries[i], s.summaries[j]
+	switch s.by {
+	case TaskSortUpdated:
+		if !a.StatusTime.Equal(b.StatusTime) {
+			return a.StatusTime.Before(b.StatusTime)
+		}
+	case TaskSortName:
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+	default:
+		if ac, bc := a.created(), b.created(); !ac.Equal(bc) {
+			return ac.Before(bc)
+		}
+	}
+	// IDs keep pages stable
+	return a.ID < b.ID
+}
+
+// created is when the task was created, or when it started for tasks saved before there were transitions.
+func (t *TaskStatus) created() time.Time {
+	if len(t.Transitions) > 0 {
+		return t.Transitions[0].Time
+	}
+	return t.StartTime
+}
@@ -0,0 +1,193 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Task Queue
+//
+// If a TaskTracker has Workers or NameLimits set, tasks wait in a queue until a worker is free and fewer than
+// NameLimits[name] tasks of the same name are running. Higher priority tasks go first, tasks with the same
+// priority run in the order they were submitted. Tasks that lock resources always go through the queue, see
+// task_locks.go.
+// ----------------------------------------------------------------------------------------------------------
+
+// TaskPriorityExecutor lets an executor jump the queue. The default priority is 0.
+type TaskPriorityExecutor interface {
+	Priority() int
+}
+
+type TaskQueueFullError struct {
+	Queued int
+}
+
+func (e *TaskQueueFullError) Error() string {
+	return fmt.Sprintf("Task Queue Full (%d tasks queued)", e.Queued)
+}
+
+type queuedTask struct {
+	task     *Task
+	priority int
+	locks    []TaskResourceLock
+	end      func(error)
+}
+
+// must hold the lock
+func (t *TaskTracker) pooled() bool {
+	return t.Workers > 0 || len(t.NameLimits) > 0
+}
+
+// submit runs the task right away if the tracker has no pool and the task locks no resources, or queues it
+// until it can run. Either way end gets the task's error once it is over, ErrTaskCancelled if it is cancelled
+// while queued.
+func (t *TaskTracker) submit(task *Task, end func(error)) error {
+	locks, wait := taskResources(task)
+	queued := false
+	defer func() {
+		// tell watchers and the store once the tracker is unlocked
+		if queued {
+			t.changed(task, TaskEventStatus)
+		}
+	}()
+	t.Lock()
+	defer t.Unlock()
+	if !t.pooled() && len(locks) == 0 {
+		go func() {
+			end(task.execute())
+		}()
+		return nil
+	}
+	if !wait && len(locks) > 0 {
+		key, holder := t.heldConflict(locks)
+		if holder == nil {
+			key, holder = t.queuedConflict(locks)
+		}
+		if holder != nil {
+			return &TaskResourceConflictError{key, holder.ID}
+		}
+	}
+	priority := 0
+	if executor, ok := task.Executor.(TaskPriorityExecutor); ok {
+		priority = executor.Priority()
+	}
+	task.Lock()
+	err := task.setState(TaskStateQueued, t.now())
+	if err == nil {
+		task.Status = StatusQueued
+	}
+	task.Unlock()
+	if err != nil {
+		return err
+	}
+	i := len(t.queue)
+	for i > 0 && t.queue[i-1].priority < priority {
+		i--
+	}
+	t.queue = append(t.queue, nil)
+	copy(t.queue[i+1:], t.queue[i:])
+	t.queue[i] = &queuedTask{task, priority, locks, end}
+	t.dispatch()
+	// only tasks that have to wait count against QueueSize
+	if position := t.queuePosition(task); position > 0 && t.QueueSize > 0 && len(t.queue) > t.QueueSize {
+		t.queue = append(t.queue[:position-1], t.queue[position:]...)
+		return &TaskQueueFullError{len(t.queue)}
+	}
+	queued = true
+	return nil
+}
+
+// must hold the lock
+func (t *TaskTracker) dispatch() {
+	if t.runningByName == nil {
+		t.runningByName = map[string]int{}
+	}
+	// keys wanted by tasks still waiting, so later tasks can't starve them
+	blocked := []TaskResourceLock{}
+	for i := 0; i < len(t.queue); {
+		if t.Workers > 0 && t.running >= t.Workers {
+			return
+		}
+		queued := t.queue[i]
+		name := queued.task.Name
+		if limit, limited := t.NameLimits[name]; limited && t.runningByName[name] >= limit {
+			i++
+			continue
+		}
+		if _, holder := t.heldConflict(queued.locks); holder != nil || locksConflict(queued.locks, blocked) {
+			blocked = append(blocked, queued.locks...)
+			i++
+			continue
+		}
+		t.queue = append(t.queue[:i], t.queue[i+1:]...)
+		t.acquire(queued.task, queued.locks)
+		t.running++
+		t.runningByName[name]++
+		go func() {
+			queued.task.Lock()
+			queued.task.Status = StatusInit
+			queued.task.Unlock()
+			t.changed(queued.task, TaskEventStatus)
+			queued.end(queued.task.execute())
+			// a timed out executor still holds on to its worker and resources until it returns
+			if executing := queued.task.overrunning(); executing != nil {
+				<-executing
+			}
+			t.Lock()
+			t.running--
+			t.runningByName[name]--
+			t.release(queued.task, queued.locks)
+			t.dispatch()
+			t.Unlock()
+		}()
+	}
+}
+
+// dequeue removes a task that hasn't started yet, returning nil if it isn't queued.
+func (t *TaskTracker) dequeue(task *Task) *queuedTask {
+	t.Lock()
+	defer t.Unlock()
+	for i, queued := range t.queue {
+		if queued.task == task {
+			t.queue = append(t.queue[:i], t.queue[i+1:]...)
+			return queued
+		}
+	}
+	return nil
+}
+
+// must hold the lock (or the read lock)
+func (t *TaskTracker) queuePosition(task *Task) int {
+	for i, queued := range t.queue {
+		if queued.task == task {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Queued returns the number of tasks waiting for a worker.
+func (t *TaskTracker) Queued() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.queue)
+}
+
+// Running returns the number of tasks started from the queue. Without a pool that is only the tasks that lock
+// resources.
+func (t *TaskTracker) Running() int {
+	t.RLock()
+	defer t.RUnlock()
+	return t.running
+}
@@ -0,0 +1,96 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+type TaskRetryPolicy struct {
+	Attempts   int           // including the first one
+	Backoff    time.Duration // before the second attempt, doubled for every one after that
+	MaxBackoff time.Duration // 0 for no limit
+	Retryable  func(error) bool
+}
+
+// TaskRetryExecutor makes a task run Execute again when it fails with an error the policy's Retryable
+// accepts, or any error if Retryable is nil. Cancelled tasks and panics are never retried, and a
+// TaskTimeoutExecutor's timeout covers all the attempts together.
+type TaskRetryExecutor interface {
+	RetryPolicy() TaskRetryPolicy
+}
+
+type TaskAttempt struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Err       string
+}
+
+func (a TaskAttempt) String() string {
+	if a.Err == "" {
+		return fmt.Sprintf("ok in %s", a.EndTime.Sub(a.StartTime))
+	}
+	return fmt.Sprintf("%s after %s", a.Err, a.EndTime.Sub(a.StartTime))
+}
+
+// executeAttempts runs Execute as many times as the executor's retry policy allows.
+func (t *Task) executeAttempts() error {
+	policy := TaskRetryPolicy{Attempts: 1}
+	if executor, ok := t.Executor.(TaskRetryExecutor); ok {
+		policy = executor.RetryPolicy()
+	}
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		start := t.Tracker.now()
+		err := t.safely(func() error {
+			return t.Executor.Execute(t)
+		})
+		if policy.Attempts <= 1 {
+			// no retries, so there is nothing to record that the status doesn't already say
+			return err
+		}
+		record := TaskAttempt{start, t.Tracker.now(), ""}
+		if err != nil {
+			record.Err = err.Error()
+		}
+		t.Lock()
+		done := t.Done
+		if !done {
+			t.Attempts = append(t.Attempts, record)
+		}
+		t.Unlock()
+		if done {
+			// timed out while this attempt ran
+			return err
+		}
+		t.Tracker.changed(t, TaskEventStatus)
+		if err == nil || attempt >= policy.Attempts || t.Cancelled() || !policy.retryable(err) {
+			return err
+		}
+		t.Log("Attempt %d/%d failed, retrying in %s: %s", attempt, policy.Attempts, backoff, err.Error())
+		if sleepErr := t.Sleep(backoff); sleepErr != nil {
+			return err
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+func (p TaskRetryPolicy) retryable(err error) bool {
+	if _, panicked := err.(*TaskPanicError); panicked || err == ErrTaskCancelled {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
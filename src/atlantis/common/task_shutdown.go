@@ -0,0 +1,145 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"context"
+	"time"
+)
+
+const DefaultShutdownGrace = 5 * time.Second
+
+// ShutdownReport lists the tasks that were still unfinished when Shutdown was called by how they ended.
+type ShutdownReport struct {
+	Drained   []string // finished on their own
+	Cancelled []string // cancelled once the deadline passed
+	Abandoned []string // still running ShutdownGrace after being cancelled
+}
+
+func (t *TaskTracker) ShuttingDown() bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.shuttingDown
+}
+
+// Shutdown stops accepting tasks and waits for the unfinished ones until ctx is done, at which point it cancels
+// the rest and gives them ShutdownGrace to stop. Timed out tasks whose executors are still running count as
+// unfinished. It then stops the background goroutines and closes the store. The error is the store's, or
+// ctx's if tasks had to be cancelled.
+func (t *TaskTracker) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	t.Lock()
+	t.shuttingDown = true
+	tasks := make([]*Task, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		tasks = append(tasks, task)
+	}
+	for task := range t.overrunning {
+		if t.tasks[task.ID] != task {
+			tasks = append(tasks, task)
+		}
+	}
+	grace := t.ShutdownGrace
+	t.Unlock()
+	if grace <= 0 {
+		grace = DefaultShutdownGrace
+	}
+	tasks = unfinishedTasks(tasks)
+	t.logf(LogInfo, "Shutting Down with %d unfinished tasks", len(tasks))
+
+	report := &ShutdownReport{Drained: []string{}, Cancelled: []string{}, Abandoned: []string{}}
+	remaining := t.waitForTasks(tasks, ctx.Done())
+	for _, task := range tasks {
+		if !containsTask(remaining, task) {
+			report.Drained = append(report.Drained, task.ID)
+		}
+	}
+	var err error
+	if len(remaining) > 0 {
+		err = ctx.Err()
+		for _, task := range remaining {
+			// through the tracker so queued tasks are dequeued and end right away
+			t.Cancel(task.ID)
+		}
+		graceCtx, cancel := context.WithTimeout(context.Background(), grace)
+		abandoned := t.waitForTasks(remaining, graceCtx.Done())
+		cancel()
+		for _, task := range remaining {
+			if containsTask(abandoned, task) {
+				report.Abandoned = append(report.Abandoned, task.ID)
+			} else {
+				report.Cancelled = append(report.Cancelled, task.ID)
+			}
+		}
+	}
+
+	t.Stop()
+	t.Lock()
+	store := t.Store
+	t.Store = nil
+	t.Unlock()
+	if store != nil {
+		if closeErr := store.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	t.logf(LogInfo, "Shut Down: %d drained, %d cancelled, %d abandoned", len(report.Drained), len(report.Cancelled),
+		len(report.Abandoned))
+	return report, err
+}
+
+// waitForTasks waits until every task is finished or stop fires and returns the unfinished tasks.
+func (t *TaskTracker) waitForTasks(tasks []*Task, stop <-chan struct{}) []*Task {
+	w := t.WatchAll(func(e TaskEvent) bool { return e.Kind == TaskEventDone })
+	defer w.Close()
+	for {
+		tasks = unfinishedTasks(tasks)
+		if len(tasks) == 0 {
+			return tasks
+		}
+		// done tasks send no more events, so wait on a timed out executor directly
+		var executing <-chan struct{}
+		for _, task := range tasks {
+			if executing = task.overrunning(); executing != nil {
+				break
+			}
+		}
+		select {
+		case <-w.Events:
+		case <-executing:
+		case <-stop:
+			return unfinishedTasks(tasks)
+		}
+	}
+}
+
+// unfinishedTasks returns the tasks that aren't done or whose timed out executors are still running.
+func unfinishedTasks(tasks []*Task) []*Task {
+	unfinished := []*Task{}
+	for _, task := range tasks {
+		task.RLock()
+		done := task.Done
+		task.RUnlock()
+		if !done || task.overrunning() != nil {
+			unfinished = append(unfinished, task)
+		}
+	}
+	return unfinished
+}
+
+func containsTask(tasks []*Task, task *Task) bool {
+	for _, t := range tasks {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
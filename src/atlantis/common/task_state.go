@@ -0,0 +1,98 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"time"
+)
+
+// TaskState is where a task is in its lifecycle. Unlike TaskStatus.Status, which executors fill with progress
+// messages, it only ever moves forward along the transitions below.
+type TaskState string
+
+const (
+	TaskStateNew         TaskState = "new"
+	TaskStateQueued      TaskState = "queued"
+	TaskStateRunning     TaskState = "running"
+	TaskStateSucceeded   TaskState = "succeeded"
+	TaskStateFailed      TaskState = "failed"
+	TaskStateCancelled   TaskState = "cancelled"
+	TaskStateTimedOut    TaskState = "timed_out"
+	TaskStateInterrupted TaskState = "interrupted"
+	// only used for workflow steps that never ran because a step they depend on failed
+	TaskStateSkipped TaskState = "skipped"
+)
+
+var taskTransitions = map[TaskState][]TaskState{
+	TaskStateNew: []TaskState{TaskStateQueued, TaskStateRunning, TaskStateFailed, TaskStateCancelled,
+		TaskStateInterrupted},
+	TaskStateQueued: []TaskState{TaskStateRunning, TaskStateFailed, TaskStateCancelled, TaskStateInterrupted},
+	TaskStateRunning: []TaskState{TaskStateSucceeded, TaskStateFailed, TaskStateCancelled, TaskStateTimedOut,
+		TaskStateInterrupted},
+}
+
+type TaskTransition struct {
+	State TaskState
+	Time  time.Time
+}
+
+type TaskStateError struct {
+	From TaskState
+	To   TaskState
+}
+
+func (e *TaskStateError) Error() string {
+	return "Invalid Task State Transition: " + string(e.From) + " -> " + string(e.To)
+}
+
+func (s TaskState) Terminal() bool {
+	switch s {
+	case TaskStateSucceeded, TaskStateFailed, TaskStateCancelled, TaskStateTimedOut, TaskStateInterrupted:
+		return true
+	}
+	return false
+}
+
+func (s TaskState) CanTransition(to TaskState) bool {
+	if s == "" {
+		// tasks saved before there were states
+		s = TaskStateNew
+	}
+	for _, allowed := range taskTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold the lock
+func (t *Task) setState(to TaskState, now time.Time) error {
+	if !t.State.CanTransition(to) {
+		return &TaskStateError{t.State, to}
+	}
+	t.State = to
+	t.Transitions = append(t.Transitions, TaskTransition{to, now})
+	return nil
+}
+
+// transition moves the task to a new state, logging transitions that aren't allowed rather than making them.
+func (t *Task) transition(to TaskState) {
+	t.Lock()
+	err := t.setState(to, t.Tracker.now())
+	t.Unlock()
+	if err != nil {
+		t.Logf(LogWarn, nil, "%s", err.Error())
+		return
+	}
+	t.Tracker.changed(t, TaskEventStatus)
+}
@@ -0,0 +1,227 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// TaskStore persists tasks so that a TaskTracker can pick them back up after a restart.
+type TaskStore interface {
+	Save(rec *TaskRecord) error
+	Delete(id string) error
+	Load() ([]*TaskRecord, error)
+	Close() error
+}
+
+// TaskRecord is everything the tracker needs to answer Status and Result for a task. Results are gob-encoded,
+// so result types have to be registered with gob.Register to be persisted.
+type TaskRecord struct {
+	ID      string
+	Status  TaskStatus
+	Err     string
+	Result  interface{}
+	Deleted bool
+}
+
+const DefaultTaskJournalCompactAfter = 10000
+
+var ErrTaskStoreClosed = errors.New("Task Store Closed")
+
+// FileTaskStore is an append-only journal of TaskRecords. The latest record for an ID wins, and the journal is
+// rewritten with only the live records when it gets too big.
+type FileTaskStore struct {
+	sync.Mutex
+	Path         string
+	CompactAfter int
+	file         *os.File
+	live         map[string]*TaskRecord
+	entries      int
+}
+
+func NewFileTaskStore(path string) (*FileTaskStore, error) {
+	s := &FileTaskStore{Path: path, CompactAfter: DefaultTaskJournalCompactAfter, live: map[string]*TaskRecord{}}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	// start from a clean journal, this also drops a half written record from a crash
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileTaskStore) replay() error {
+	file, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		rec, err := readTaskRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			log.Printf("[TaskStore] skipping the rest of %s: %s", s.Path, err.Error())
+			return nil
+		}
+		if rec.Deleted {
+			delete(s.live, rec.ID)
+		} else {
+			s.live[rec.ID] = rec
+		}
+	}
+}
+
+func readTaskRecord(r io.Reader) (*TaskRecord, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	rec := &TaskRecord{}
+	return rec, gob.NewDecoder(bytes.NewReader(data)).Decode(rec)
+}
+
+func encodeTaskRecord(rec *TaskRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0})
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data, nil
+}
+
+// must hold the lock
+func (s *FileTaskStore) compact() error {
+	tmp := s.Path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, rec := range s.live {
+		data, err := encodeTaskRecord(rec)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(data)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	if s.file, err = os.OpenFile(s.Path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	s.entries = len(s.live)
+	return nil
+}
+
+// must hold the lock
+func (s *FileTaskStore) append(data []byte) error {
+	if s.file == nil {
+		return ErrTaskStoreClosed
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	if s.entries++; s.entries > s.CompactAfter && s.entries > 2*len(s.live) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileTaskStore) Save(rec *TaskRecord) error {
+	data, err := encodeTaskRecord(rec)
+	if err != nil && rec.Result != nil {
+		// most likely an unregistered result type. keep the status, it's what people poll for.
+		log.Printf("[TaskStore] dropping result of %s: %s", rec.ID, err.Error())
+		stripped := *rec
+		stripped.Result = nil
+		rec = &stripped
+		data, err = encodeTaskRecord(rec)
+	}
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.live[rec.ID] = rec
+	return s.append(data)
+}
+
+func (s *FileTaskStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, present := s.live[id]; !present {
+		return nil
+	}
+	delete(s.live, id)
+	data, err := encodeTaskRecord(&TaskRecord{ID: id, Deleted: true})
+	if err != nil {
+		return err
+	}
+	return s.append(data)
+}
+
+func (s *FileTaskStore) Load() ([]*TaskRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+	recs := make([]*TaskRecord, 0, len(s.live))
+	for _, rec := range s.live {
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func (s *FileTaskStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,1206 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type TaskSuite struct{}
+
+var _ = gocheck.Suite(&TaskSuite{})
+
+type TestTaskResult struct {
+	Value string
+}
+
+func init() {
+	gob.Register(&TestTaskResult{})
+}
+
+type testTaskExecutor struct {
+	result  interface{}
+	execute func(t *Task) error
+}
+
+func (e *testTaskExecutor) Request() interface{} {
+	return nil
+}
+
+func (e *testTaskExecutor) Result() interface{} {
+	return e.result
+}
+
+func (e *testTaskExecutor) Description() string {
+	return "test task"
+}
+
+func (e *testTaskExecutor) Execute(t *Task) error {
+	if e.execute == nil {
+		return nil
+	}
+	return e.execute(t)
+}
+
+func (e *testTaskExecutor) Authorize() error {
+	return nil
+}
+
+func newTestTracker() *TaskTracker {
+	return NewTaskTracker(TaskTrackerOptions{ResultDuration: time.Minute})
+}
+
+func newTestTask(tracker *TaskTracker, name string, executor TaskExecutor) *Task {
+	return NewTaskOn(tracker, name, executor)
+}
+
+func waitForTask(c *gocheck.C, tracker *TaskTracker, id string) *TaskStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, _ := tracker.Status(id)
+		if status.Done {
+			return status
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatal("timed out waiting for task " + id)
+	return nil
+}
+
+func (s *TaskSuite) TestFileTaskStore(c *gocheck.C) {
+	path := c.MkDir() + "/tasks.journal"
+	store, err := NewFileTaskStore(path)
+	c.Assert(err, gocheck.IsNil)
+	tracker := newTestTracker()
+	c.Assert(tracker.UseStore(store), gocheck.IsNil)
+
+	var done, running AsyncReply
+	executor := &testTaskExecutor{result: &TestTaskResult{"deployed"}, execute: func(t *Task) error {
+		t.AddWarning("careful")
+		return nil
+	}}
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&done), gocheck.IsNil)
+	waitForTask(c, tracker, done.ID)
+	block := make(chan bool)
+	defer close(block)
+	started := make(chan bool)
+	executor = &testTaskExecutor{execute: func(t *Task) error {
+		t.LogStatus("Halfway")
+		started <- true
+		<-block
+		return nil
+	}}
+	c.Assert(newTestTask(tracker, "Teardown", executor).RunAsync(&running), gocheck.IsNil)
+	<-started
+	c.Assert(store.Close(), gocheck.IsNil)
+
+	// "restart"
+	store, err = NewFileTaskStore(path)
+	c.Assert(err, gocheck.IsNil)
+	defer store.Close()
+	tracker = newTestTracker()
+	c.Assert(tracker.UseStore(store), gocheck.IsNil)
+	status, err := tracker.Status(done.ID)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(status.Name, gocheck.Equals, "Deploy")
+	c.Check(status.Status, gocheck.Equals, StatusDone)
+	c.Check(status.Warnings, gocheck.DeepEquals, []string{"careful"})
+	c.Check(tracker.Result(done.ID), gocheck.DeepEquals, &TestTaskResult{"deployed"})
+	status, err = tracker.Status(running.ID)
+	c.Check(err, gocheck.Equals, ErrTaskInterrupted)
+	c.Check(status.Status, gocheck.Equals, StatusInterrupted)
+	c.Check(status.Done, gocheck.Equals, true)
+
+	tracker.ReleaseTaskID(done.ID)
+	recs, err := store.Load()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(recs, gocheck.HasLen, 1)
+	c.Check(recs[0].ID, gocheck.Equals, running.ID)
+}
+
+func (s *TaskSuite) TestCancel(c *gocheck.C) {
+	tracker := newTestTracker()
+	started := make(chan bool)
+	executor := &testTaskExecutor{execute: func(t *Task) error {
+		started <- true
+		for i := 0; i < 100; i++ {
+			if err := t.Sleep(time.Second); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	<-started
+	c.Assert(tracker.Cancel(reply.ID), gocheck.IsNil)
+	status := waitForTask(c, tracker, reply.ID)
+	c.Check(status.Status, gocheck.Equals, StatusCancelled)
+	_, err := tracker.Status(reply.ID)
+	c.Check(err, gocheck.Equals, ErrTaskCancelled)
+	c.Check(tracker.Cancel(reply.ID), gocheck.ErrorMatches, "Task Already Done")
+	c.Check(tracker.Cancel("nope"), gocheck.ErrorMatches, "Unknown Task")
+}
+
+type testTimeoutExecutor struct {
+	testTaskExecutor
+	timeout time.Duration
+}
+
+func (e *testTimeoutExecutor) Timeout() time.Duration {
+	return e.timeout
+}
+
+func (s *TaskSuite) TestTimeout(c *gocheck.C) {
+	tracker := newTestTracker()
+	hung := make(chan bool)
+	finished := make(chan bool)
+	executor := &testTimeoutExecutor{testTaskExecutor{execute: func(t *Task) error {
+		<-hung // ignores its context entirely
+		t.LogStatus("still going")
+		t.AddWarning("late")
+		t.SetStep(2, 2, "late")
+		close(finished)
+		return nil
+	}}, 20 * time.Millisecond}
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	w, err := tracker.Watch(reply.ID)
+	c.Assert(err, gocheck.IsNil)
+	var status *TaskStatus
+	for event := range w.Events {
+		status = event.Status // the done event comes last
+	}
+	c.Check(status.Status, gocheck.Equals, StatusTimedOut)
+	_, err = tracker.Status(reply.ID)
+	c.Check(err, gocheck.Equals, ErrTaskTimedOut)
+	c.Check(tracker.Idle(nil), gocheck.Equals, true)
+
+	// the executor can't touch the finished task
+	close(hung)
+	<-finished
+	after, _ := tracker.Status(reply.ID)
+	c.Check(after, gocheck.DeepEquals, status)
+
+	// quick executors are unaffected
+	executor = &testTimeoutExecutor{testTaskExecutor{}, time.Minute}
+	c.Check(newTestTask(tracker, "Deploy", executor).Run(), gocheck.IsNil)
+}
+
+type testPriorityExecutor struct {
+	testTaskExecutor
+	priority int
+}
+
+func (e *testPriorityExecutor) Priority() int {
+	return e.priority
+}
+
+func (s *TaskSuite) TestQueue(c *gocheck.C) {
+	tracker := newTestTracker()
+	tracker.Workers = 1
+	tracker.QueueSize = 2
+	release := make(chan bool)
+	order := make(chan string, 3)
+	blocking := func(name string) *testTaskExecutor {
+		return &testTaskExecutor{execute: func(t *Task) error {
+			order <- name
+			<-release
+			return nil
+		}}
+	}
+	var first, low, high, rejected AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", blocking("first")).RunAsync(&first), gocheck.IsNil)
+	c.Check(<-order, gocheck.Equals, "first")
+	w := tracker.WatchAll(nil)
+	c.Assert(newTestTask(tracker, "Deploy", blocking("low")).RunAsync(&low), gocheck.IsNil)
+	// watchers see the task get queued
+	states := []TaskState{}
+	for len(w.Events) > 0 {
+		event := <-w.Events
+		states = append(states, event.Status.State)
+	}
+	w.Close()
+	c.Check(states, gocheck.DeepEquals, []TaskState{TaskStateNew, TaskStateQueued})
+	executor := &testPriorityExecutor{*blocking("high"), 5}
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&high), gocheck.IsNil)
+	status, _ := tracker.Status(high.ID)
+	c.Check(status.Status, gocheck.Equals, StatusQueued)
+	c.Check(status.QueuePosition, gocheck.Equals, 1)
+	status, _ = tracker.Status(low.ID)
+	c.Check(status.QueuePosition, gocheck.Equals, 2)
+	err := newTestTask(tracker, "Deploy", blocking("rejected")).RunAsync(&rejected)
+	c.Check(err, gocheck.ErrorMatches, `Task Queue Full \(2 tasks queued\)`)
+	c.Check(rejected.ID, gocheck.Equals, "")
+
+	release <- true
+	c.Check(<-order, gocheck.Equals, "high")
+	c.Check(tracker.Queued(), gocheck.Equals, 1)
+	// cancelling a queued task ends it without running it
+	c.Assert(tracker.Cancel(low.ID), gocheck.IsNil)
+	status = waitForTask(c, tracker, low.ID)
+	c.Check(status.Status, gocheck.Equals, StatusCancelled)
+	c.Check(tracker.Queued(), gocheck.Equals, 0)
+	release <- true
+	waitForTask(c, tracker, high.ID)
+
+	// so does cancelling one that is waited on with Run
+	c.Assert(newTestTask(tracker, "Deploy", blocking("running")).RunAsync(&first), gocheck.IsNil)
+	c.Check(<-order, gocheck.Equals, "running")
+	queued := newTestTask(tracker, "Deploy", blocking("never"))
+	ran := make(chan error, 1)
+	go func() {
+		ran <- queued.Run()
+	}()
+	for tracker.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued.RLock()
+	id := queued.ID
+	queued.RUnlock()
+	c.Assert(tracker.Cancel(id), gocheck.IsNil)
+	select {
+	case err := <-ran:
+		c.Check(err, gocheck.Equals, ErrTaskCancelled)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't return after its queued task was cancelled")
+	}
+	release <- true
+	waitForTask(c, tracker, first.ID)
+}
+
+func (s *TaskSuite) TestQueueNameLimits(c *gocheck.C) {
+	tracker := newTestTracker()
+	tracker.NameLimits = map[string]int{"Deploy": 1}
+	tracker.Workers = 4
+	tracker.QueueSize = 1
+	release := make(chan bool)
+	started := make(chan string, 3)
+	blocking := func(name string) *testTaskExecutor {
+		return &testTaskExecutor{execute: func(t *Task) error {
+			started <- name
+			<-release
+			return nil
+		}}
+	}
+	var deploy1, deploy2, teardown AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", blocking("deploy1")).RunAsync(&deploy1), gocheck.IsNil)
+	c.Assert(newTestTask(tracker, "Deploy", blocking("deploy2")).RunAsync(&deploy2), gocheck.IsNil)
+	c.Assert(newTestTask(tracker, "Teardown", blocking("teardown")).RunAsync(&teardown), gocheck.IsNil)
+	got := map[string]bool{<-started: true, <-started: true}
+	c.Check(got, gocheck.DeepEquals, map[string]bool{"deploy1": true, "teardown": true})
+	status, _ := tracker.Status(deploy2.ID)
+	c.Check(status.QueuePosition, gocheck.Equals, 1)
+	// tasks that can start right away don't count against QueueSize, those that would wait do
+	var deploy3 AsyncReply
+	err := newTestTask(tracker, "Deploy", blocking("deploy3")).RunAsync(&deploy3)
+	c.Check(err, gocheck.ErrorMatches, `Task Queue Full \(1 tasks queued\)`)
+	c.Check(tracker.Queued(), gocheck.Equals, 1)
+	release <- true
+	release <- true
+	c.Check(<-started, gocheck.Equals, "deploy2")
+	release <- true
+	waitForTask(c, tracker, deploy2.ID)
+}
+
+func transitionStates(status *TaskStatus) []TaskState {
+	states := []TaskState{}
+	for _, transition := range status.Transitions {
+		states = append(states, transition.State)
+	}
+	return states
+}
+
+func (s *TaskSuite) TestStates(c *gocheck.C) {
+	tracker := newTestTracker()
+	var reply AsyncReply
+	executor := &testTaskExecutor{execute: func(t *Task) error {
+		t.LogStatus("Deploying 3 containers")
+		return nil
+	}}
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	status := waitForTask(c, tracker, reply.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateSucceeded)
+	c.Check(transitionStates(status), gocheck.DeepEquals,
+		[]TaskState{TaskStateNew, TaskStateRunning, TaskStateSucceeded})
+	c.Check(status.Transitions[2].Time, gocheck.Equals, status.EndTime)
+
+	tracker.Workers = 1
+	executor = &testTaskExecutor{execute: func(t *Task) error {
+		return errors.New("no")
+	}}
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	status = waitForTask(c, tracker, reply.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateFailed)
+	c.Check(transitionStates(status), gocheck.DeepEquals,
+		[]TaskState{TaskStateNew, TaskStateQueued, TaskStateRunning, TaskStateFailed})
+
+	c.Check(TaskStateFailed.Terminal(), gocheck.Equals, true)
+	c.Check(TaskStateQueued.Terminal(), gocheck.Equals, false)
+	task := newTestTask(tracker, "Deploy", executor)
+	c.Check(task.setState(TaskStateSucceeded, time.Now()), gocheck.ErrorMatches,
+		"Invalid Task State Transition: new -> succeeded")
+	c.Check(task.State, gocheck.Equals, TaskStateNew)
+}
+
+func (s *TaskSuite) TestSubtasks(c *gocheck.C) {
+	tracker := newTestTracker()
+	var waitErr error
+	executor := &testTaskExecutor{execute: func(t *Task) error {
+		for i := 0; i < 3; i++ {
+			fail := i == 1
+			_, err := t.Spawn("DeployContainer", &testTaskExecutor{execute: func(t *Task) error {
+				if fail {
+					return errors.New("boom")
+				}
+				return nil
+			}})
+			if err != nil {
+				return err
+			}
+		}
+		waitErr = t.WaitSubtasks()
+		return nil
+	}}
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	status := waitForTask(c, tracker, reply.ID)
+	c.Check(waitErr, gocheck.ErrorMatches, "1 of 3 subtasks failed: boom")
+	c.Check(status.Subtasks, gocheck.Equals, TaskSubtaskSummary{Total: 3, Succeeded: 2, Failed: 1})
+	c.Check(status.Subtasks.String(), gocheck.Equals, "3/3 subtasks done, 1 failed")
+
+	tree, err := tracker.StatusTree(reply.ID)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(tree.ID, gocheck.Equals, reply.ID)
+	c.Assert(tree.Children, gocheck.HasLen, 3)
+	states := []TaskState{}
+	for i, child := range tree.Children {
+		c.Check(child.ID, gocheck.Equals, status.ChildIDs[i])
+		c.Check(child.Status.ParentID, gocheck.Equals, reply.ID)
+		states = append(states, child.Status.State)
+	}
+	c.Check(states, gocheck.DeepEquals, []TaskState{TaskStateSucceeded, TaskStateFailed, TaskStateSucceeded})
+}
+
+func (s *TaskSuite) TestSubtasksFailFast(c *gocheck.C) {
+	tracker := newTestTracker()
+	var slowID string
+	var waitErr, spawnErr error
+	executor := &testTaskExecutor{execute: func(t *Task) error {
+		t.SetFailFast(true)
+		slow, _ := t.Spawn("Slow", &testTaskExecutor{execute: func(t *Task) error {
+			return t.Sleep(time.Minute)
+		}})
+		slowID = slow.ID
+		t.Spawn("Broken", &testTaskExecutor{execute: func(t *Task) error {
+			return errors.New("boom")
+		}})
+		waitErr = t.WaitSubtasks()
+		_, spawnErr = t.Spawn("Late", &testTaskExecutor{})
+		return waitErr
+	}}
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	status := waitForTask(c, tracker, reply.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateFailed)
+	c.Check(waitErr, gocheck.ErrorMatches, "1 of 2 subtasks failed: boom")
+	c.Check(spawnErr, gocheck.ErrorMatches, "boom")
+	status, _ = tracker.Status(slowID)
+	c.Check(status.State, gocheck.Equals, TaskStateCancelled)
+
+	// cancelling the parent cancels its children
+	executor = &testTaskExecutor{execute: func(t *Task) error {
+		child, _ := t.Spawn("Slow", &testTaskExecutor{execute: func(t *Task) error {
+			return t.Sleep(time.Minute)
+		}})
+		slowID = child.ID
+		t.Cancel()
+		return t.WaitSubtasks()
+	}}
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	status = waitForTask(c, tracker, reply.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateCancelled)
+	status, _ = tracker.Status(slowID)
+	c.Check(status.State, gocheck.Equals, TaskStateCancelled)
+}
+
+func (s *TaskSuite) TestWorkflow(c *gocheck.C) {
+	tracker := newTestTracker()
+	// build and test run in parallel, both wait for checkout
+	started := make(chan string, 2)
+	release := make(chan bool)
+	parallel := func(t *Task) error {
+		started <- t.Name
+		<-release
+		return nil
+	}
+	workflow := NewWorkflow("deploy app", nil)
+	c.Assert(workflow.AddStep("checkout", &testTaskExecutor{}), gocheck.IsNil)
+	c.Assert(workflow.AddStep("build", &testTaskExecutor{execute: parallel}, "checkout"), gocheck.IsNil)
+	c.Assert(workflow.AddStep("test", &testTaskExecutor{execute: parallel}, "checkout"), gocheck.IsNil)
+	c.Assert(workflow.AddStep("deploy", &testTaskExecutor{}, "build", "test"), gocheck.IsNil)
+	c.Check(workflow.AddStep("deploy", &testTaskExecutor{}), gocheck.ErrorMatches, "Duplicate Workflow Step: deploy")
+	c.Check(workflow.AddStep("notify", &testTaskExecutor{}, "nope"), gocheck.ErrorMatches,
+		"Unknown Workflow Step: nope")
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", workflow).RunAsync(&reply), gocheck.IsNil)
+	<-started
+	<-started
+	close(release)
+	status := waitForTask(c, tracker, reply.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateSucceeded)
+	c.Assert(status.Workflow, gocheck.HasLen, 4)
+	for _, step := range status.Workflow {
+		c.Check(step.State, gocheck.Equals, TaskStateSucceeded)
+		child, _ := tracker.Status(step.TaskID)
+		c.Check(child.Name, gocheck.Equals, step.Name)
+	}
+
+	// a failed step skips everything that depends on it
+	workflow = NewWorkflow("deploy app", nil)
+	workflow.AddStep("checkout", &testTaskExecutor{})
+	workflow.AddStep("build", &testTaskExecutor{execute: func(t *Task) error {
+		return errors.New("boom")
+	}}, "checkout")
+	workflow.AddStep("test", &testTaskExecutor{}, "checkout")
+	workflow.AddStep("deploy", &testTaskExecutor{}, "build", "test")
+	workflow.AddStep("notify", &testTaskExecutor{}, "deploy")
+	c.Assert(newTestTask(tracker, "Deploy", workflow).RunAsync(&reply), gocheck.IsNil)
+	status = waitForTask(c, tracker, reply.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateFailed)
+	states := map[string]TaskState{}
+	for _, step := range status.Workflow {
+		states[step.Name] = step.State
+	}
+	c.Check(states, gocheck.DeepEquals, map[string]TaskState{"checkout": TaskStateSucceeded,
+		"build": TaskStateFailed, "test": TaskStateSucceeded, "deploy": TaskStateSkipped,
+		"notify": TaskStateSkipped})
+	_, err := tracker.Status(reply.ID)
+	c.Check(err, gocheck.ErrorMatches, `Workflow Failed: 1 steps failed \[build\], 2 skipped \[deploy notify\]: boom`)
+}
+
+func (s *TaskSuite) TestProgress(c *gocheck.C) {
+	tracker := newTestTracker()
+	task := newTestTask(tracker, "Deploy", &testTaskExecutor{})
+	tracker.ReserveTaskID(task)
+	task.SetStep(2, 4, "build")
+	status, _ := tracker.Status(task.ID)
+	c.Check(status.Progress.Step, gocheck.Equals, "build")
+	c.Check(status.Progress.Percent, gocheck.Equals, 25.0)
+	task.SetPercent(150)
+	task.SetETA(time.Minute)
+	task.AddWarning("slow")
+	status, _ = tracker.Status(task.ID)
+	c.Check(status.Progress.Percent, gocheck.Equals, 100.0)
+	c.Check(status.Progress.ETA.After(time.Now()), gocheck.Equals, true)
+	c.Check(status.Map()["Progress"], gocheck.Equals, status.Progress)
+	c.Check(status.String(), gocheck.Matches, "(?s).*Progress    : step 2/4 build, 100%, ETA .*")
+
+	// the copy doesn't share anything with the task
+	status.Warnings[0] = "changed"
+	task.AddWarning("slower")
+	status, _ = tracker.Status(task.ID)
+	c.Check(status.Warnings, gocheck.DeepEquals, []string{"slow", "slower"})
+}
+
+func (s *TaskSuite) TestWatch(c *gocheck.C) {
+	tracker := newTestTracker()
+	all := tracker.WatchAll(func(e TaskEvent) bool { return e.Status.Name == "Deploy" })
+	defer all.Close()
+	started := make(chan bool)
+	proceed := make(chan bool)
+	executor := &testTaskExecutor{execute: func(t *Task) error {
+		started <- true
+		<-proceed
+		t.LogStatus("building")
+		t.AddWarning("slow")
+		return nil
+	}}
+	task := newTestTask(tracker, "Deploy", executor)
+	var reply AsyncReply
+	c.Assert(task.RunAsync(&reply), gocheck.IsNil)
+	c.Assert(newTestTask(tracker, "Other", &testTaskExecutor{}).RunAsync(&AsyncReply{}), gocheck.IsNil)
+	<-started
+	w, err := tracker.Watch(reply.ID)
+	c.Assert(err, gocheck.IsNil)
+	status, _ := tracker.Status(reply.ID)
+	version := status.Version
+
+	// nothing changes until the executor proceeds
+	status, err = tracker.WaitForChange(reply.ID, version, 10*time.Millisecond)
+	c.Check(err, gocheck.IsNil)
+	c.Check(status.Version, gocheck.Equals, version)
+	close(proceed)
+	status, err = tracker.WaitForChange(reply.ID, version, 5*time.Second)
+	c.Check(err, gocheck.IsNil)
+	c.Check(status.Version > version, gocheck.Equals, true)
+
+	kinds := []TaskEventKind{}
+	for event := range w.Events {
+		c.Check(event.ID, gocheck.Equals, reply.ID)
+		kinds = append(kinds, event.Kind)
+	}
+	c.Check(kinds, gocheck.DeepEquals, []TaskEventKind{TaskEventStatus, TaskEventWarning, TaskEventDone})
+	c.Check(w.Dropped(), gocheck.Equals, 0)
+
+	kinds = []TaskEventKind{}
+	for len(all.Events) > 0 {
+		event := <-all.Events
+		kinds = append(kinds, event.Kind)
+	}
+	c.Check(kinds, gocheck.DeepEquals, []TaskEventKind{TaskEventCreated, TaskEventStatus, TaskEventStatus,
+		TaskEventWarning, TaskEventDone})
+
+	_, err = tracker.Watch("nope")
+	c.Check(err, gocheck.ErrorMatches, "Unknown Task")
+	status, _ = tracker.WaitForChange(reply.ID, status.Version, time.Minute)
+	c.Check(status.Done, gocheck.Equals, true)
+}
+
+type testLabelledExecutor struct {
+	testTaskExecutor
+	user   string
+	labels map[string]string
+}
+
+func (e *testLabelledExecutor) User() string {
+	return e.user
+}
+
+func (e *testLabelledExecutor) Labels() map[string]string {
+	return e.labels
+}
+
+func (s *TaskSuite) TestQuery(c *gocheck.C) {
+	tracker := newTestTracker()
+	run := func(name, user, env string, err error) string {
+		executor := &testLabelledExecutor{user: user, labels: map[string]string{"env": env}}
+		executor.execute = func(t *Task) error { return err }
+		var reply AsyncReply
+		c.Assert(newTestTask(tracker, name, executor).RunAsync(&reply), gocheck.IsNil)
+		waitForTask(c, tracker, reply.ID)
+		return reply.ID
+	}
+	first := run("Deploy", "alice", "prod", errors.New("boom"))
+	run("Deploy", "bob", "prod", nil)
+	third := run("Teardown", "alice", "staging", errors.New("boom"))
+	fourth := run("Deploy", "alice", "prod", errors.New("boom"))
+
+	ids := func(summaries []TaskSummary) []string {
+		ids := []string{}
+		for _, summary := range summaries {
+			ids = append(ids, summary.ID)
+		}
+		return ids
+	}
+	failed, total := tracker.Query(TaskQuery{States: []TaskState{TaskStateFailed},
+		Since: time.Now().Add(-time.Hour)})
+	c.Check(total, gocheck.Equals, 3)
+	c.Check(ids(failed), gocheck.DeepEquals, []string{first, third, fourth})
+	c.Check(failed[0].User, gocheck.Equals, "alice")
+	c.Check(failed[0].Err, gocheck.ErrorMatches, "boom")
+
+	page, total := tracker.Query(TaskQuery{Names: []string{"Deploy"}, User: "alice",
+		Labels: map[string]string{"env": "prod"}, Descending: true, Limit: 1})
+	c.Check(total, gocheck.Equals, 2)
+	c.Check(ids(page), gocheck.DeepEquals, []string{fourth})
+	page, _ = tracker.Query(TaskQuery{Names: []string{"Deploy"}, User: "alice", Descending: true, Offset: 1})
+	c.Check(ids(page), gocheck.DeepEquals, []string{first})
+	page, total = tracker.Query(TaskQuery{Offset: -1, Limit: -1})
+	c.Check(total, gocheck.Equals, 4)
+	c.Check(page, gocheck.HasLen, 4)
+	page, total = tracker.Query(TaskQuery{Until: time.Now().Add(-time.Hour)})
+	c.Check(total, gocheck.Equals, 0)
+	c.Check(page, gocheck.HasLen, 0)
+}
+
+type testClock struct {
+	now    time.Time
+	timers chan func()
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) AfterFunc(d time.Duration, f func()) {
+	c.timers <- f
+}
+
+func (s *TaskSuite) TestTrackerOptions(c *gocheck.C) {
+	var logged bytes.Buffer
+	clock := &testClock{time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC), make(chan func(), 1)}
+	tracker := NewTaskTracker(TaskTrackerOptions{Logger: NewTextTaskLogger(log.New(&logged, "", 0), LogInfo),
+		Clock: clock})
+	task := NewTaskOn(tracker, "Deploy", &testTaskExecutor{})
+	c.Check(task.Tracker, gocheck.Equals, tracker)
+	c.Check(task.Run(), gocheck.IsNil)
+	c.Check(task.EndTime, gocheck.Equals, clock.now)
+	c.Check(logged.String(), gocheck.Matches, "(?s).*\\[RPC\\]\\[Deploy\\].* End test task\n")
+
+	var reply AsyncReply
+	c.Assert(NewTaskOn(tracker, "Deploy", &testTaskExecutor{}).RunAsync(&reply), gocheck.IsNil)
+	waitForTask(c, tracker, reply.ID)
+	// results are released when the clock says so
+	release := <-clock.timers
+	release()
+	status, _ := tracker.Status(reply.ID)
+	c.Check(status, gocheck.Equals, TaskStatusUnknown)
+
+	dir := c.MkDir()
+	done := make(chan bool)
+	go func() {
+		tracker.MaintenanceChecker(filepath.Join(dir, "maint"), time.Millisecond)
+		done <- true
+	}()
+	tracker.Stop()
+	tracker.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("maintenance checker didn't stop")
+	}
+}
+
+func (s *TaskSuite) TestPanic(c *gocheck.C) {
+	tracker := newTestTracker()
+	executor := &testTaskExecutor{result: &TestTaskResult{"partial"}, execute: func(t *Task) error {
+		var deployed map[string]bool
+		deployed["app"] = true
+		return nil
+	}}
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	status := waitForTask(c, tracker, reply.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateFailed)
+	c.Check(status.Warnings, gocheck.DeepEquals, []string{"Recovered Panic: assignment to entry in nil map"})
+	_, err := tracker.Status(reply.ID)
+	c.Assert(err, gocheck.FitsTypeOf, &TaskPanicError{})
+	c.Check(string(err.(*TaskPanicError).Stack), gocheck.Matches, "(?s).*TestPanic.*")
+	c.Check(err, gocheck.ErrorMatches, "Task Panicked: assignment to entry in nil map")
+	c.Check(tracker.Result(reply.ID), gocheck.DeepEquals, &TestTaskResult{"partial"})
+	c.Check(tracker.RecoveredPanics(), gocheck.Equals, uint64(1))
+}
+
+func (s *TaskSuite) TestShutdown(c *gocheck.C) {
+	store, err := NewFileTaskStore(filepath.Join(c.MkDir(), "tasks"))
+	c.Assert(err, gocheck.IsNil)
+	tracker := NewTaskTracker(TaskTrackerOptions{ResultDuration: time.Minute, ShutdownGrace: time.Second})
+	c.Assert(tracker.UseStore(store), gocheck.IsNil)
+	started := make(chan bool, 3)
+	var quick, slow, stuck AsyncReply
+	c.Assert(NewTaskOn(tracker, "Quick", &testTaskExecutor{execute: func(t *Task) error {
+		started <- true
+		for !t.Tracker.ShuttingDown() {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}}).RunAsync(&quick), gocheck.IsNil)
+	c.Assert(NewTaskOn(tracker, "Slow", &testTaskExecutor{execute: func(t *Task) error {
+		started <- true
+		return t.Sleep(time.Minute)
+	}}).RunAsync(&slow), gocheck.IsNil)
+	release := make(chan bool)
+	c.Assert(NewTaskOn(tracker, "Stuck", &testTaskExecutor{execute: func(t *Task) error {
+		started <- true
+		<-release
+		return nil
+	}}).RunAsync(&stuck), gocheck.IsNil)
+	defer close(release)
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := tracker.Shutdown(ctx)
+	c.Check(err, gocheck.Equals, context.DeadlineExceeded)
+	c.Check(report, gocheck.DeepEquals, &ShutdownReport{Drained: []string{quick.ID},
+		Cancelled: []string{slow.ID}, Abandoned: []string{stuck.ID}})
+	c.Check(NewTaskOn(tracker, "Late", &testTaskExecutor{}).Run(), gocheck.Equals, ErrShuttingDown)
+
+	// the cancelled task was saved before the store was closed
+	store, err = NewFileTaskStore(store.Path)
+	c.Assert(err, gocheck.IsNil)
+	recs, err := store.Load()
+	c.Assert(err, gocheck.IsNil)
+	states := map[string]TaskState{}
+	for _, rec := range recs {
+		states[rec.ID] = rec.Status.State
+	}
+	c.Check(states, gocheck.DeepEquals, map[string]TaskState{quick.ID: TaskStateSucceeded,
+		slow.ID: TaskStateCancelled, stuck.ID: TaskStateRunning})
+	store.Close()
+}
+
+func (s *TaskSuite) TestShutdownTimedOut(c *gocheck.C) {
+	tracker := NewTaskTracker(TaskTrackerOptions{ResultDuration: time.Minute, ShutdownGrace: 50 * time.Millisecond})
+	release := make(chan bool)
+	defer close(release)
+	hung := func() *testTimeoutExecutor {
+		return &testTimeoutExecutor{testTaskExecutor{execute: func(t *Task) error {
+			<-release // ignores its context entirely
+			return nil
+		}}, 10 * time.Millisecond}
+	}
+	var async AsyncReply
+	c.Assert(NewTaskOn(tracker, "Async", hung()).RunAsync(&async), gocheck.IsNil)
+	// Run releases the task as soon as it ends, its executor is still tracked
+	task := NewTaskOn(tracker, "Sync", hung())
+	c.Assert(task.Run(), gocheck.Equals, ErrTaskTimedOut)
+	waitForTask(c, tracker, async.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report, err := tracker.Shutdown(ctx)
+	c.Check(err, gocheck.Equals, context.DeadlineExceeded)
+	sort.Strings(report.Abandoned)
+	abandoned := []string{async.ID, task.ID}
+	sort.Strings(abandoned)
+	c.Check(report, gocheck.DeepEquals, &ShutdownReport{Drained: []string{}, Cancelled: []string{},
+		Abandoned: abandoned})
+}
+
+type testResourceExecutor struct {
+	testTaskExecutor
+	locks []TaskResourceLock
+	wait  bool
+}
+
+func (e *testResourceExecutor) Resources() []TaskResourceLock {
+	return e.locks
+}
+
+func (e *testResourceExecutor) WaitForResources() bool {
+	return e.wait
+}
+
+func (s *TaskSuite) TestResourceLocks(c *gocheck.C) {
+	tracker := newTestTracker()
+	release := make(chan bool)
+	started := make(chan string, 3)
+	run := func(name string, shared, wait bool) (string, error) {
+		executor := &testResourceExecutor{locks: []TaskResourceLock{{"app/sha/env", shared}}, wait: wait}
+		executor.execute = func(t *Task) error {
+			started <- t.Name
+			<-release
+			return nil
+		}
+		var reply AsyncReply
+		err := newTestTask(tracker, name, executor).RunAsync(&reply)
+		return reply.ID, err
+	}
+	first, err := run("Inspect1", true, false)
+	c.Assert(err, gocheck.IsNil)
+	_, err = run("Inspect2", true, false)
+	c.Assert(err, gocheck.IsNil)
+	<-started
+	<-started
+
+	// exclusive locks conflict with the shared ones
+	_, err = run("Teardown", false, false)
+	c.Assert(err, gocheck.FitsTypeOf, &TaskResourceConflictError{})
+	c.Check(err.(*TaskResourceConflictError).Key, gocheck.Equals, "app/sha/env")
+	c.Check(err.(*TaskResourceConflictError).TaskID, gocheck.Equals, first)
+	deploy, err := run("Deploy", false, true)
+	c.Assert(err, gocheck.IsNil)
+	// later shared locks wait behind the exclusive one instead of starving it
+	inspect, err := run("Inspect3", true, true)
+	c.Assert(err, gocheck.IsNil)
+	status, _ := tracker.Status(deploy)
+	c.Check(status.State, gocheck.Equals, TaskStateQueued)
+
+	release <- true
+	release <- true
+	c.Check(<-started, gocheck.Equals, "Deploy")
+	status, _ = tracker.Status(inspect)
+	c.Check(status.State, gocheck.Equals, TaskStateQueued)
+	release <- true
+	c.Check(<-started, gocheck.Equals, "Inspect3")
+	release <- true
+	waitForTask(c, tracker, inspect)
+}
+
+type testTimeoutResourceExecutor struct {
+	testResourceExecutor
+	timeout time.Duration
+}
+
+func (e *testTimeoutResourceExecutor) Timeout() time.Duration {
+	return e.timeout
+}
+
+func (s *TaskSuite) TestResourceLocksTimeout(c *gocheck.C) {
+	tracker := newTestTracker()
+	hung := make(chan bool)
+	locks := []TaskResourceLock{{"app/sha/env", false}}
+	executor := &testTimeoutResourceExecutor{testResourceExecutor{locks: locks, wait: true}, 20 * time.Millisecond}
+	executor.execute = func(t *Task) error {
+		<-hung // ignores its context entirely
+		return nil
+	}
+	var first, second AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy1", executor).RunAsync(&first), gocheck.IsNil)
+	c.Check(waitForTask(c, tracker, first.ID).State, gocheck.Equals, TaskStateTimedOut)
+
+	// the timed out executor still holds the lock
+	started := make(chan bool)
+	next := &testResourceExecutor{locks: locks, wait: true}
+	next.execute = func(t *Task) error {
+		close(started)
+		return nil
+	}
+	c.Assert(newTestTask(tracker, "Deploy2", next).RunAsync(&second), gocheck.IsNil)
+	time.Sleep(20 * time.Millisecond)
+	status, _ := tracker.Status(second.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateQueued)
+	c.Check(tracker.Running(), gocheck.Equals, 1)
+
+	close(hung)
+	<-started
+	c.Check(waitForTask(c, tracker, second.ID).State, gocheck.Equals, TaskStateSucceeded)
+}
+
+type testIdempotentExecutor struct {
+	testTaskExecutor
+	key string
+}
+
+func (e *testIdempotentExecutor) IdempotencyKey() string {
+	return e.key
+}
+
+func (s *TaskSuite) TestIdempotencyKeys(c *gocheck.C) {
+	clock := &testClock{time.Now(), make(chan func(), 10)}
+	tracker := NewTaskTracker(TaskTrackerOptions{ResultDuration: time.Hour, IdempotencyTTL: time.Minute,
+		Clock: clock})
+	runs := 0
+	newExecutor := func(key string) *testIdempotentExecutor {
+		executor := &testIdempotentExecutor{key: key}
+		executor.result = &TestTaskResult{"deployed"}
+		executor.execute = func(t *Task) error {
+			runs++
+			return nil
+		}
+		return executor
+	}
+	var first, retry, other AsyncReply
+	c.Assert(NewTaskOn(tracker, "Deploy", newExecutor("req-1")).RunAsync(&first), gocheck.IsNil)
+	c.Check(first.Existing, gocheck.IsNil)
+	waitForTask(c, tracker, first.ID)
+	c.Assert(NewTaskOn(tracker, "Deploy", newExecutor("req-1")).RunAsync(&retry), gocheck.IsNil)
+	c.Check(retry.ID, gocheck.Equals, first.ID)
+	c.Assert(retry.Existing, gocheck.NotNil)
+	c.Check(retry.Existing.State, gocheck.Equals, TaskStateSucceeded)
+	task := NewTaskOn(tracker, "Deploy", newExecutor("req-1"))
+	c.Check(task.Run(), gocheck.IsNil)
+	c.Check(task.ID, gocheck.Equals, first.ID)
+	c.Check(task.Result, gocheck.DeepEquals, &TestTaskResult{"deployed"})
+	c.Check(runs, gocheck.Equals, 1)
+
+	// keys are per task name and expire
+	c.Assert(NewTaskOn(tracker, "Teardown", newExecutor("req-1")).RunAsync(&other), gocheck.IsNil)
+	c.Check(other.ID, gocheck.Not(gocheck.Equals), first.ID)
+	waitForTask(c, tracker, other.ID)
+	clock.now = clock.now.Add(2 * time.Minute)
+	c.Assert(NewTaskOn(tracker, "Deploy", newExecutor("req-1")).RunAsync(&retry), gocheck.IsNil)
+	c.Check(retry.ID, gocheck.Not(gocheck.Equals), first.ID)
+	waitForTask(c, tracker, retry.ID)
+	c.Check(runs, gocheck.Equals, 3)
+}
+
+type testRetryExecutor struct {
+	testTaskExecutor
+	policy TaskRetryPolicy
+}
+
+func (e *testRetryExecutor) RetryPolicy() TaskRetryPolicy {
+	return e.policy
+}
+
+func (s *TaskSuite) TestRetries(c *gocheck.C) {
+	tracker := newTestTracker()
+	transient := errors.New("supervisor unreachable")
+	run := func(errs ...error) *TaskStatus {
+		executor := &testRetryExecutor{policy: TaskRetryPolicy{Attempts: 3, Backoff: time.Millisecond,
+			Retryable: func(err error) bool { return err == transient }}}
+		executor.execute = func(t *Task) error {
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}
+		var reply AsyncReply
+		c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+		return waitForTask(c, tracker, reply.ID)
+	}
+	status := run(transient, transient, nil)
+	c.Check(status.State, gocheck.Equals, TaskStateSucceeded)
+	c.Assert(status.Attempts, gocheck.HasLen, 3)
+	c.Check(status.Attempts[0].Err, gocheck.Equals, "supervisor unreachable")
+	c.Check(status.Attempts[2].Err, gocheck.Equals, "")
+	c.Check(status.Attempts[1].StartTime.Sub(status.Attempts[0].EndTime) >= time.Millisecond, gocheck.Equals, true)
+	c.Check(status.String(), gocheck.Matches, "(?s).*Attempts    : 3 .*")
+
+	status = run(transient, transient, transient)
+	c.Check(status.State, gocheck.Equals, TaskStateFailed)
+	c.Check(status.Attempts, gocheck.HasLen, 3)
+	status = run(transient, errors.New("bad manifest"), nil)
+	c.Check(status.State, gocheck.Equals, TaskStateFailed)
+	c.Check(status.Attempts, gocheck.HasLen, 2)
+}
+
+type testCorrelatedExecutor struct {
+	testTaskExecutor
+}
+
+func (e *testCorrelatedExecutor) CorrelationID() string {
+	return "req-42"
+}
+
+func (e *testCorrelatedExecutor) User() string {
+	return "alice"
+}
+
+func (s *TaskSuite) TestLogging(c *gocheck.C) {
+	var logged bytes.Buffer
+	tracker := NewTaskTracker(TaskTrackerOptions{Logger: NewJSONTaskLogger(&logged, LogInfo)})
+	executor := &testCorrelatedExecutor{}
+	executor.execute = func(t *Task) error {
+		t.Logf(LogDebug, nil, "hidden")
+		t.Logf(LogInfo, TaskLogFields{"host": "supervisor1"}, "Deploying")
+		t.AddWarning("slow")
+		return errors.New("boom")
+	}
+	task := NewTaskOn(tracker, "Deploy", executor)
+	c.Check(task.Run(), gocheck.ErrorMatches, "boom")
+	entries := []map[string]interface{}{}
+	decoder := json.NewDecoder(&logged)
+	for decoder.More() {
+		var entry map[string]interface{}
+		c.Assert(decoder.Decode(&entry), gocheck.IsNil)
+		c.Check(entry[LogFieldTaskID], gocheck.Equals, task.ID)
+		c.Check(entry[LogFieldUser], gocheck.Equals, "alice")
+		c.Check(entry[LogFieldCorrelationID], gocheck.Equals, "req-42")
+		delete(entry, "time")
+		delete(entry, LogFieldTaskID)
+		delete(entry, LogFieldUser)
+		delete(entry, LogFieldCorrelationID)
+		entries = append(entries, entry)
+	}
+	c.Check(entries, gocheck.DeepEquals, []map[string]interface{}{
+		{"level": "info", "msg": "Begin test task", "task_name": "Deploy"},
+		{"level": "info", "msg": "Deploying", "task_name": "Deploy", "host": "supervisor1"},
+		{"level": "warn", "msg": "WARNING: slow", "task_name": "Deploy"},
+		{"level": "error", "msg": "End test task - Error: boom", "task_name": "Deploy"},
+	})
+
+	var text bytes.Buffer
+	NewTextTaskLogger(log.New(&text, "", 0), LogInfo).Log(LogWarn, "slow",
+		TaskLogFields{LogFieldTaskName: "Deploy", LogFieldTaskID: "abc", LogFieldUser: "alice"})
+	c.Check(text.String(), gocheck.Equals, "[RPC][Deploy][abc] slow user=alice\n")
+}
+
+func (s *TaskSuite) TestLogBuffer(c *gocheck.C) {
+	tracker := NewTaskTracker(TaskTrackerOptions{ResultDuration: time.Minute, LogLines: 5,
+		Logger: NewTextTaskLogger(log.New(&bytes.Buffer{}, "", 0), LogError)})
+	executor := &testTaskExecutor{execute: func(t *Task) error {
+		t.LogStatus("step %d", 1)
+		t.AddWarning("slow")
+		for i := 2; i <= 4; i++ {
+			t.Log("step %d", i)
+		}
+		return nil
+	}}
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", executor).RunAsync(&reply), gocheck.IsNil)
+	waitForTask(c, tracker, reply.ID)
+	msgs := func(lines []TaskLogLine) []string {
+		msgs := []string{}
+		for _, line := range lines {
+			msgs = append(msgs, fmt.Sprintf("%d %s", line.Seq, line.Msg))
+		}
+		return msgs
+	}
+	// lines dropped from the buffer are skipped, filtered levels are still kept
+	lines, next, err := tracker.Logs(reply.ID, 0, 2)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(msgs(lines), gocheck.DeepEquals, []string{"2 WARNING: slow", "3 step 2"})
+	c.Check(lines[0].Level, gocheck.Equals, LogWarn)
+	lines, next, _ = tracker.Logs(reply.ID, next, 0)
+	c.Check(msgs(lines), gocheck.DeepEquals, []string{"4 step 3", "5 step 4", "6 End test task"})
+	lines, next, _ = tracker.Logs(reply.ID, next, 0)
+	c.Check(lines, gocheck.HasLen, 0)
+	c.Check(next, gocheck.Equals, 7)
+	lines, _ = tracker.TailLogs(reply.ID, 2)
+	c.Check(msgs(lines), gocheck.DeepEquals, []string{"5 step 4", "6 End test task"})
+	_, err = tracker.TailLogs("nope", 2)
+	c.Check(err, gocheck.ErrorMatches, "Unknown Task")
+}
+
+func (s *TaskSuite) TestMetrics(c *gocheck.C) {
+	tracker := newTestTracker()
+	release := make(chan bool)
+	for _, err := range []error{nil, nil, errors.New("boom")} {
+		err := err
+		c.Check(newTestTask(tracker, "Deploy \"app\"", &testTaskExecutor{execute: func(t *Task) error {
+			return err
+		}}).Run(), gocheck.Equals, err)
+	}
+	var reply AsyncReply
+	c.Assert(newTestTask(tracker, "Teardown", &testTaskExecutor{execute: func(t *Task) error {
+		<-release
+		return nil
+	}}).RunAsync(&reply), gocheck.IsNil)
+	defer close(release)
+	for status, _ := tracker.Status(reply.ID); status.State != TaskStateRunning; {
+		time.Sleep(time.Millisecond)
+		status, _ = tracker.Status(reply.ID)
+	}
+	tracker.SetMaintenance(true)
+	// tasks turned away count as rejected, not as failed runs
+	c.Check(newTestTask(tracker, "Deploy \"app\"", &testTaskExecutor{}).Run(), gocheck.Equals, ErrMaintenance)
+
+	server := httptest.NewServer(tracker.MetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	c.Assert(err, gocheck.IsNil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(resp.Header.Get("Content-Type"), gocheck.Equals, "text/plain; version=0.0.4")
+	lines := map[string]bool{}
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+	missing := []string{}
+	for _, line := range []string{
+		"# TYPE atlantis_tasks_total counter",
+		`atlantis_tasks_total{name="Deploy \"app\"",outcome="failed"} 1`,
+		`atlantis_tasks_total{name="Deploy \"app\"",outcome="succeeded"} 2`,
+		"# TYPE atlantis_task_duration_seconds histogram",
+		`atlantis_task_duration_seconds_bucket{name="Deploy \"app\"",outcome="succeeded",le="0.1"} 2`,
+		`atlantis_task_duration_seconds_bucket{name="Deploy \"app\"",outcome="succeeded",le="+Inf"} 2`,
+		`atlantis_task_duration_seconds_count{name="Deploy \"app\"",outcome="failed"} 1`,
+		"# TYPE atlantis_tasks_rejected_total counter",
+		`atlantis_tasks_rejected_total{name="Deploy \"app\"",reason="maintenance"} 1`,
+		`atlantis_tasks_running{name="Teardown"} 1`,
+		"atlantis_tasks_queued 0",
+		"atlantis_task_panics_total 0",
+		"atlantis_maintenance 1",
+	} {
+		if !lines[line] {
+			missing = append(missing, line)
+		}
+	}
+	c.Check(missing, gocheck.DeepEquals, []string{})
+}
+
+func (s *TaskSuite) TestHTTPHandler(c *gocheck.C) {
+	tracker := newTestTracker()
+	release := make(chan bool)
+	var running, failed AsyncReply
+	c.Assert(newTestTask(tracker, "Deploy", &testTaskExecutor{execute: func(t *Task) error {
+		t.AddWarning("<slow>")
+		<-release
+		return nil
+	}}).RunAsync(&running), gocheck.IsNil)
+	defer close(release)
+	c.Assert(newTestTask(tracker, "Teardown", &testTaskExecutor{execute: func(t *Task) error {
+		return errors.New("boom")
+	}}).RunAsync(&failed), gocheck.IsNil)
+	waitForTask(c, tracker, failed.ID)
+	for status, _ := tracker.Status(running.ID); len(status.Warnings) == 0; {
+		time.Sleep(time.Millisecond)
+		status, _ = tracker.Status(running.ID)
+	}
+
+	server := httptest.NewServer(http.StripPrefix("/tasks-ui", tracker.HTTPHandler()))
+	defer server.Close()
+	get := func(path string, v interface{}) (int, string) {
+		resp, err := http.Get(server.URL + "/tasks-ui" + path)
+		c.Assert(err, gocheck.IsNil)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if v != nil {
+			c.Assert(json.Unmarshal(body, v), gocheck.IsNil)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	var task map[string]interface{}
+	code, _ := get("/tasks/"+failed.ID, &task)
+	c.Check(code, gocheck.Equals, http.StatusOK)
+	c.Check(task["ID"], gocheck.Equals, failed.ID)
+	c.Check(task["Name"], gocheck.Equals, "Teardown")
+	c.Check(task["State"], gocheck.Equals, "failed")
+	c.Check(task["Error"], gocheck.Equals, "boom")
+	code, _ = get("/tasks/nope", &task)
+	c.Check(code, gocheck.Equals, http.StatusNotFound)
+
+	var list struct {
+		Tasks []map[string]interface{}
+		Total int
+	}
+	code, _ = get("/tasks?state=running&state=queued", &list)
+	c.Check(code, gocheck.Equals, http.StatusOK)
+	c.Check(list.Total, gocheck.Equals, 1)
+	c.Assert(list.Tasks, gocheck.HasLen, 1)
+	c.Check(list.Tasks[0]["ID"], gocheck.Equals, running.ID)
+	code, _ = get("/tasks?limit=1", &list)
+	c.Check(list.Total, gocheck.Equals, 2)
+	c.Check(list.Tasks, gocheck.HasLen, 1)
+	code, _ = get("/tasks?limit=x", nil)
+	c.Check(code, gocheck.Equals, http.StatusBadRequest)
+
+	code, page := get("/", nil)
+	c.Check(code, gocheck.Equals, http.StatusOK)
+	c.Check(page, gocheck.Matches, "(?s).*Running \\(1\\).*"+running.ID+".*&lt;slow&gt;.*Recent \\(1\\).*"+
+		failed.ID+".*")
+}
+
+func (s *TaskSuite) TestShutdownQueued(c *gocheck.C) {
+	tracker := NewTaskTracker(TaskTrackerOptions{ResultDuration: time.Minute, Workers: 1,
+		ShutdownGrace: 50 * time.Millisecond})
+	release := make(chan bool)
+	defer close(release)
+	started := make(chan bool)
+	var stuck, queued AsyncReply
+	c.Assert(NewTaskOn(tracker, "Stuck", &testTaskExecutor{execute: func(t *Task) error {
+		started <- true
+		<-release // ignores cancellation
+		return nil
+	}}).RunAsync(&stuck), gocheck.IsNil)
+	<-started
+	c.Assert(NewTaskOn(tracker, "Queued", &testTaskExecutor{}).RunAsync(&queued), gocheck.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report, err := tracker.Shutdown(ctx)
+	c.Check(err, gocheck.Equals, context.DeadlineExceeded)
+	c.Check(report, gocheck.DeepEquals, &ShutdownReport{Drained: []string{}, Cancelled: []string{queued.ID},
+		Abandoned: []string{stuck.ID}})
+	status, _ := tracker.Status(queued.ID)
+	c.Check(status.State, gocheck.Equals, TaskStateCancelled)
+}
@@ -0,0 +1,99 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"time"
+)
+
+// TaskClock is where a TaskTracker gets the time from, so tests can control it.
+type TaskClock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+type systemClock struct{}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c systemClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+type TaskTrackerOptions struct {
+	ResultDuration time.Duration // how long results of async tasks are kept around
+	Workers        int
+	QueueSize      int
+	NameLimits     map[string]int
+	Logger         TaskLogger // nil to log text with the standard logger
+	Clock          TaskClock  // nil for the system clock
+	ShutdownGrace  time.Duration
+	IdempotencyTTL time.Duration
+	LogLines       int
+}
+
+func NewTaskTracker(opts TaskTrackerOptions) *TaskTracker {
+	nameLimits := make(map[string]int, len(opts.NameLimits))
+	for name, limit := range opts.NameLimits {
+		nameLimits[name] = limit
+	}
+	return &TaskTracker{
+		ResultDuration: opts.ResultDuration,
+		Workers:        opts.Workers,
+		QueueSize:      opts.QueueSize,
+		NameLimits:     nameLimits,
+		Logger:         opts.Logger,
+		Clock:          opts.Clock,
+		ShutdownGrace:  opts.ShutdownGrace,
+		IdempotencyTTL: opts.IdempotencyTTL,
+		LogLines:       opts.LogLines,
+		tasks:          map[string]*Task{},
+		stop:           make(chan struct{}),
+	}
+}
+
+// Stop ends the tracker's background goroutines, such as MaintenanceChecker. Tasks keep running.
+func (t *TaskTracker) Stop() {
+	stop := t.stopChan()
+	t.Lock()
+	defer t.Unlock()
+	if !t.stopped {
+		t.stopped = true
+		close(stop)
+	}
+}
+
+func (t *TaskTracker) stopChan() chan struct{} {
+	t.Lock()
+	defer t.Unlock()
+	if t.stop == nil {
+		t.stop = make(chan struct{})
+	}
+	return t.stop
+}
+
+func (t *TaskTracker) now() time.Time {
+	if t.Clock == nil {
+		return time.Now()
+	}
+	return t.Clock.Now()
+}
+
+func (t *TaskTracker) afterFunc(d time.Duration, f func()) {
+	if t.Clock == nil {
+		time.AfterFunc(d, f)
+		return
+	}
+	t.Clock.AfterFunc(d, f)
+}
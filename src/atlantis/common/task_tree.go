@@ -0,0 +1,157 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Subtasks
+//
+// An executor can split its work into child tasks with Spawn and collect them with WaitSubtasks. Children are
+// tracked like any other task, are cancelled along with their parent and skip maintenance checks and the
+// worker queue, since their parent already got past both.
+// ----------------------------------------------------------------------------------------------------------
+
+type TaskSubtaskSummary struct {
+	Total     int
+	Running   int
+	Succeeded int
+	Failed    int
+	Cancelled int
+}
+
+func (s TaskSubtaskSummary) String() string {
+	str := fmt.Sprintf("%d/%d subtasks done", s.Succeeded+s.Failed+s.Cancelled, s.Total)
+	if s.Failed > 0 {
+		str += fmt.Sprintf(", %d failed", s.Failed)
+	}
+	if s.Cancelled > 0 {
+		str += fmt.Sprintf(", %d cancelled", s.Cancelled)
+	}
+	return str
+}
+
+type SubtaskError struct {
+	Summary TaskSubtaskSummary
+	First   error
+}
+
+func (e *SubtaskError) Error() string {
+	return fmt.Sprintf("%d of %d subtasks failed: %s", e.Summary.Failed, e.Summary.Total, e.First.Error())
+}
+
+type TaskTree struct {
+	ID       string
+	Status   *TaskStatus
+	Children []*TaskTree
+}
+
+// SetFailFast makes the first failing subtask cancel its siblings and stop further spawns. Otherwise the
+// remaining subtasks keep going and WaitSubtasks reports every failure at the end.
+func (t *Task) SetFailFast(failFast bool) {
+	t.Lock()
+	t.failFast = failFast
+	t.Unlock()
+}
+
+// Spawn starts executor as a child of t.
+func (t *Task) Spawn(name string, executor TaskExecutor) (*Task, error) {
+	return t.spawn(name, executor, nil)
+}
+
+// spawn starts a child and calls onEnd with its error once it is done.
+func (t *Task) spawn(name string, executor TaskExecutor, onEnd func(error)) (*Task, error) {
+	ctx := t.Context()
+	child := NewTaskOn(t.Tracker, name, executor)
+	child.ctx, child.cancel = context.WithCancel(ctx)
+	child.parent = t
+	child.onEnd = onEnd
+	t.Lock()
+	if t.subtaskErr != nil && t.failFast {
+		err := t.subtaskErr
+		t.Unlock()
+		return nil, err
+	}
+	child.ParentID = t.ID
+	if child.CorrelationID == "" {
+		child.CorrelationID = t.CorrelationID
+	}
+	t.children = append(t.children, child)
+	t.Subtasks.Total++
+	t.Subtasks.Running++
+	t.subtasks.Add(1)
+	t.Unlock()
+	id := t.Tracker.ReserveTaskID(child)
+	t.Lock()
+	t.ChildIDs = append(t.ChildIDs, id)
+	t.Unlock()
+	go func() {
+		child.End(child.execute(), true)
+	}()
+	return child, nil
+}
+
+// WaitSubtasks waits for every subtask spawned so far and returns a SubtaskError if any of them failed.
+func (t *Task) WaitSubtasks() error {
+	t.subtasks.Wait()
+	t.RLock()
+	defer t.RUnlock()
+	if t.subtaskErr != nil {
+		return &SubtaskError{t.Subtasks, t.subtaskErr}
+	}
+	return nil
+}
+
+// subtaskEnded is called by a child once it is done.
+func (t *Task) subtaskEnded(child *Task, err error) {
+	var cancel []*Task
+	t.Lock()
+	t.Subtasks.Running--
+	if err == nil {
+		t.Subtasks.Succeeded++
+	} else if err == ErrTaskCancelled {
+		t.Subtasks.Cancelled++
+	} else {
+		t.Subtasks.Failed++
+		if t.subtaskErr == nil {
+			t.subtaskErr = err
+			if t.failFast {
+				cancel = t.children
+			}
+		}
+	}
+	t.Unlock()
+	for _, sibling := range cancel {
+		if sibling != child {
+			sibling.Cancel()
+		}
+	}
+	t.subtasks.Done()
+}
+
+// StatusTree returns the status of a task and all of its subtasks that are still tracked.
+func (t *TaskTracker) StatusTree(id string) (*TaskTree, error) {
+	status, err := t.Status(id)
+	if status == TaskStatusUnknown {
+		return nil, err
+	}
+	tree := &TaskTree{ID: id, Status: status, Children: []*TaskTree{}}
+	for _, childID := range status.ChildIDs {
+		if child, _ := t.StatusTree(childID); child != nil {
+			tree.Children = append(tree.Children, child)
+		}
+	}
+	return tree, nil
+}
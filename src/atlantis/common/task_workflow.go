@@ -0,0 +1,210 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// Workflows
+//
+// A Workflow is a TaskExecutor made of steps that depend on each other. Every step runs as a subtask as soon
+// as all of its dependencies succeeded, so independent steps run in parallel. If a step fails, everything
+// that depends on it is skipped. The state of every step is kept in the workflow task's status.
+// ----------------------------------------------------------------------------------------------------------
+
+type WorkflowStepStatus struct {
+	Name      string
+	DependsOn []string
+	State     TaskState
+	TaskID    string
+}
+
+type workflowStep struct {
+	name      string
+	executor  TaskExecutor
+	dependsOn []string
+}
+
+type Workflow struct {
+	description string
+	request     interface{}
+	steps       []*workflowStep
+	byName      map[string]*workflowStep
+}
+
+type WorkflowError struct {
+	Failed  []string
+	Skipped []string
+	First   error
+}
+
+func (e *WorkflowError) Error() string {
+	return fmt.Sprintf("Workflow Failed: %d steps failed %v, %d skipped %v: %s", len(e.Failed), e.Failed,
+		len(e.Skipped), e.Skipped, e.First.Error())
+}
+
+func NewWorkflow(description string, request interface{}) *Workflow {
+	return &Workflow{description: description, request: request, byName: map[string]*workflowStep{}}
+}
+
+// AddStep adds a step that runs once every step in dependsOn succeeded. Dependencies have to be added first,
+// which also keeps the graph free of cycles.
+func (w *Workflow) AddStep(name string, executor TaskExecutor, dependsOn ...string) error {
+	if _, present := w.byName[name]; present {
+		return errors.New("Duplicate Workflow Step: " + name)
+	}
+	for _, dep := range dependsOn {
+		if _, present := w.byName[dep]; !present {
+			return errors.New("Unknown Workflow Step: " + dep)
+		}
+	}
+	step := &workflowStep{name, executor, dependsOn}
+	w.steps = append(w.steps, step)
+	w.byName[name] = step
+	return nil
+}
+
+func (w *Workflow) Request() interface{} {
+	return w.request
+}
+
+// Result maps step names to their executors' results.
+func (w *Workflow) Result() interface{} {
+	results := make(map[string]interface{}, len(w.steps))
+	for _, step := range w.steps {
+		results[step.name] = step.executor.Result()
+	}
+	return results
+}
+
+func (w *Workflow) Description() string {
+	return w.description
+}
+
+func (w *Workflow) Authorize() error {
+	for _, step := range w.steps {
+		if err := step.executor.Authorize(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type workflowStepResult struct {
+	index int
+	err   error
+}
+
+func (w *Workflow) Execute(t *Task) error {
+	statuses := make([]WorkflowStepStatus, len(w.steps))
+	index := make(map[string]int, len(w.steps))
+	waiting := make([]int, len(w.steps))
+	dependants := make([][]int, len(w.steps))
+	for i, step := range w.steps {
+		index[step.name] = i
+		statuses[i] = WorkflowStepStatus{step.name, step.dependsOn, TaskStateNew, ""}
+		waiting[i] = len(step.dependsOn)
+		for _, dep := range step.dependsOn {
+			dependants[index[dep]] = append(dependants[index[dep]], i)
+		}
+	}
+	publish := func() {
+		t.Lock()
+		t.Workflow = copyWorkflowSteps(statuses)
+		t.Unlock()
+		t.Tracker.changed(t, TaskEventStatus)
+	}
+	results := make(chan workflowStepResult)
+	start := func(i int) {
+		statuses[i].State = TaskStateRunning
+		child, err := t.spawn(w.steps[i].name, w.steps[i].executor, func(err error) {
+			results <- workflowStepResult{i, err}
+		})
+		if err != nil {
+			go func() { results <- workflowStepResult{i, err} }()
+			return
+		}
+		statuses[i].TaskID = child.ID
+	}
+	var skip func(i int) int
+	skip = func(i int) int {
+		skipped := 0
+		for _, dependant := range dependants[i] {
+			if statuses[dependant].State == TaskStateNew {
+				statuses[dependant].State = TaskStateSkipped
+				skipped += 1 + skip(dependant)
+			}
+		}
+		return skipped
+	}
+
+	for i := range w.steps {
+		if waiting[i] == 0 {
+			start(i)
+		}
+	}
+	publish()
+	wfErr := &WorkflowError{Failed: []string{}, Skipped: []string{}}
+	for pending := len(w.steps); pending > 0; {
+		result := <-results
+		pending--
+		switch result.err {
+		case nil:
+			statuses[result.index].State = TaskStateSucceeded
+			for _, dependant := range dependants[result.index] {
+				if waiting[dependant]--; waiting[dependant] == 0 && statuses[dependant].State == TaskStateNew {
+					start(dependant)
+				}
+			}
+		case ErrTaskCancelled:
+			statuses[result.index].State = TaskStateCancelled
+			pending -= skip(result.index)
+		case ErrTaskTimedOut:
+			statuses[result.index].State = TaskStateTimedOut
+			pending -= skip(result.index)
+		default:
+			statuses[result.index].State = TaskStateFailed
+			pending -= skip(result.index)
+		}
+		if result.err != nil {
+			wfErr.Failed = append(wfErr.Failed, w.steps[result.index].name)
+			if wfErr.First == nil {
+				wfErr.First = result.err
+			}
+		}
+		publish()
+	}
+	if wfErr.First == nil {
+		return nil
+	}
+	for _, status := range statuses {
+		if status.State == TaskStateSkipped {
+			wfErr.Skipped = append(wfErr.Skipped, status.Name)
+		}
+	}
+	return wfErr
+}
+
+func copyWorkflowSteps(steps []WorkflowStepStatus) []WorkflowStepStatus {
+	if steps == nil {
+		return nil
+	}
+	copied := make([]WorkflowStepStatus, len(steps))
+	for i, step := range steps {
+		copied[i] = step
+		copied[i].DependsOn = append([]string(nil), step.DependsOn...)
+	}
+	return copied
+}